@@ -0,0 +1,184 @@
+// Package canon rewrites URLs into a canonical form, so variants of the same
+// address are crawled and stored once.
+package canon
+
+import (
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Rules adjust which query parameters survive. Names are matched case
+// insensitively; a trailing * matches any suffix, as in "utm_*".
+type Rules struct {
+	Strip []string // Parameters to drop on top of DefaultStrip
+	Keep  []string // If set, the only parameters kept, even if on a strip list
+}
+
+// DefaultStrip lists tracking and session parameters that never change what
+// a page shows.
+var DefaultStrip = []string{
+	"utm_*",
+	"gclid",
+	"fbclid",
+	"msclkid",
+	"dclid",
+	"yclid",
+	"mc_cid",
+	"mc_eid",
+	"_ga",
+	"spm",
+	"phpsessid",
+	"jsessionid",
+	"aspsessionid*",
+}
+
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+// Session IDs some servers put into the path, e.g. /a;jsessionid=1F2E
+var pathSession = regexp.MustCompile(`(?i);jsessionid=[^/?]*`)
+
+// URL returns the canonical form of rawurl: scheme lower case, host as Host
+// returns it, default port, fragment and dot segments gone, percent-encoding
+// normalized and the query stripped of duplicate and unwanted parameters and
+// sorted.
+func URL(rawurl string, r Rules) (canonical string, err error) {
+	u, err := url.Parse(strings.TrimSpace(rawurl))
+	if err != nil {
+		return
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	if u.Host != "" {
+		var host string
+		if host, err = Host(u.Hostname()); err != nil {
+			return
+		}
+		port := u.Port()
+		if defaultPorts[u.Scheme] == port {
+			port = ""
+		}
+		u.Host = joinHost(host, port)
+	}
+	u.Fragment, u.RawFragment = "", ""
+
+	p := escapes(pathSession.ReplaceAllString(u.EscapedPath(), ""))
+	if p == "" && u.Host != "" {
+		p = "/"
+	}
+	if strings.Contains(p, "/.") {
+		clean := path.Clean(p)
+		if strings.HasSuffix(p, "/") && clean != "/" {
+			clean += "/"
+		}
+		p = clean
+	}
+	if u.Path, err = url.PathUnescape(p); err != nil {
+		return
+	}
+	u.RawPath = p
+
+	u.RawQuery = r.query(u.RawQuery)
+	u.ForceQuery = false
+	return u.String(), nil
+}
+
+// query drops duplicate and unwanted parameters from raw and sorts the rest.
+func (r Rules) query(raw string) string {
+	if raw == "" {
+		return ""
+	}
+	seen := make(map[string]bool)
+	params := make([]string, 0, strings.Count(raw, "&")+1)
+	for _, param := range strings.Split(raw, "&") {
+		if param == "" {
+			continue
+		}
+		param = escapes(param)
+		name := param
+		if i := strings.Index(name, "="); i >= 0 {
+			name = name[:i]
+		}
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if !r.keep(name) || seen[param] {
+			continue
+		}
+		seen[param] = true
+		params = append(params, param)
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+func (r Rules) keep(name string) bool {
+	if len(r.Keep) > 0 {
+		return matches(r.Keep, name)
+	}
+	return !matches(DefaultStrip, name) && !matches(r.Strip, name)
+}
+
+func matches(patterns []string, name string) bool {
+	name = strings.ToLower(name)
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		if p == name || (strings.HasSuffix(p, "*") && strings.HasPrefix(name, p[:len(p)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// escapes decodes percent-encoded unreserved characters and upper cases the
+// hex digits of the others, so equivalent encodings compare equal.
+func escapes(s string) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' || i+2 >= len(s) || !isHex(s[i+1]) || !isHex(s[i+2]) {
+			b = append(b, s[i])
+			continue
+		}
+		c := unhex(s[i+1])<<4 | unhex(s[i+2])
+		if unreserved(c) {
+			b = append(b, c)
+		} else {
+			b = append(b, '%', upper(s[i+1]), upper(s[i+2]))
+		}
+		i += 2
+	}
+	return string(b)
+}
+
+func unreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case c <= '9':
+		return c - '0'
+	case c <= 'F':
+		return c - 'A' + 10
+	}
+	return c - 'a' + 10
+}
+
+func upper(c byte) byte {
+	if 'a' <= c && c <= 'f' {
+		return c - 'a' + 'A'
+	}
+	return c
+}
@@ -0,0 +1,75 @@
+package canon
+
+import (
+	"launchpad.net/gocheck"
+	"testing"
+)
+
+type CanonSuite struct{}
+
+var _ = gocheck.Suite(new(CanonSuite))
+
+func Test(t *testing.T) { gocheck.TestingT(t) }
+
+func (s *CanonSuite) TestURL(c *gocheck.C) {
+	tests := map[string]string{
+		"HTTP://WWW.Moko.CC":                                      "http://www.moko.cc/",
+		"http://www.moko.cc:80/a#top":                             "http://www.moko.cc/a",
+		"https://www.moko.cc:443/a":                               "https://www.moko.cc/a",
+		"http://www.moko.cc:8080/a":                               "http://www.moko.cc:8080/a",
+		"http://www.moko.cc./a/./b/../c/":                         "http://www.moko.cc/a/c/",
+		"http://www.moko.cc/%7euser/%e6%a8%a1":                    "http://www.moko.cc/~user/%E6%A8%A1",
+		"http://www.moko.cc/a%2fb":                                "http://www.moko.cc/a%2Fb",
+		"http://www.moko.cc/x;jsessionid=1F2E?b=2":                "http://www.moko.cc/x?b=2",
+		"http://www.moko.cc/?actionkey=X&actionkey=X":             "http://www.moko.cc/?actionkey=X",
+		"http://www.moko.cc/?b=2&a=1&a=0":                         "http://www.moko.cc/?a=0&a=1&b=2",
+		"http://www.moko.cc/?utm_source=x&id=1&gclid=y&UTM_term=": "http://www.moko.cc/?id=1",
+		"http://www.moko.cc/?q=%e6%a8%a1+%41&&":                   "http://www.moko.cc/?q=%E6%A8%A1+A",
+		"http://www.moko.cc/?utm_source=x":                        "http://www.moko.cc/",
+		"http://WWW.中国政府.CN:80/a":                                 "http://www.xn--fiqs8sirgfmh.cn/a",
+	}
+	for in, exp := range tests {
+		out, err := URL(in, Rules{})
+		c.Check(err, gocheck.IsNil)
+		c.Check(out, gocheck.Equals, exp, gocheck.Commentf(in))
+	}
+}
+
+func (s *CanonSuite) TestRules(c *gocheck.C) {
+	out, err := URL("http://www.moko.cc/?page=2&from=nav&ref_id=3", Rules{Strip: []string{"from", "ref_*"}})
+	c.Assert(err, gocheck.IsNil)
+	c.Check(out, gocheck.Equals, "http://www.moko.cc/?page=2")
+
+	out, err = URL("http://www.moko.cc/?page=2&sort=new&utm_source=x&spm=1", Rules{Keep: []string{"page", "spm"}})
+	c.Assert(err, gocheck.IsNil)
+	c.Check(out, gocheck.Equals, "http://www.moko.cc/?page=2&spm=1")
+
+	_, err = URL("http://[::1", Rules{})
+	c.Check(err, gocheck.NotNil)
+}
+
+func (s *CanonSuite) TestRegistrable(c *gocheck.C) {
+	tests := map[string]string{
+		"http://www.moko.cc/a":            "moko.cc",
+		"http://IMG.moko.cc:8080/":        "moko.cc",
+		"http://a.b.moko.com.cn/":         "moko.com.cn",
+		"http://www.127.0.0.1.xip.io/":    "xip.io",
+		"http://127.0.0.1:8084/":          "127.0.0.1:8084",
+		"http://[::1]:80/":                "[::1]:80",
+		"http://www.中国政府.cn/":             "xn--fiqs8sirgfmh.cn",
+		"http://WWW.XN--FIQS8SIRGFMH.cn/": "xn--fiqs8sirgfmh.cn",
+		"http://新华网.中国/":                  "xn--xkrr14bows.xn--fiqs8s",
+	}
+	for in, exp := range tests {
+		name, err := Registrable(in)
+		c.Check(err, gocheck.IsNil)
+		c.Check(name, gocheck.Equals, exp, gocheck.Commentf(in))
+	}
+
+	for _, in := range []string{"/relative", "http://[::1", "mailto:a@moko.cc", "http://xn--99999999999.cn/"} {
+		_, err := Registrable(in)
+		c.Check(err, gocheck.NotNil, gocheck.Commentf(in))
+	}
+	c.Check(Display("xn--fiqs8sirgfmh.cn"), gocheck.Equals, "中国政府.cn")
+	c.Check(Display("moko.cc"), gocheck.Equals, "moko.cc")
+}
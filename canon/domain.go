@@ -0,0 +1,73 @@
+package canon
+
+import (
+	"code.google.com/p/go.net/idna"
+	"code.google.com/p/go.net/publicsuffix"
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+)
+
+var ErrNoHost = errors.New("URL has no host")
+
+// Registrable returns the registrable domain of rawurl's host, the public
+// suffix plus one label ("moko.cc" for "img.moko.cc", "moko.com.cn" for
+// "www.moko.com.cn"). Hosts without one, such as IP addresses and
+// localhost, are returned as they are, port included and "www." dropped.
+// International names are returned in their ASCII form, see Host.
+func Registrable(rawurl string) (name string, err error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return
+	}
+	if u.Host == "" {
+		return "", ErrNoHost
+	}
+	host, err := Host(u.Hostname())
+	if err != nil {
+		return
+	}
+	if net.ParseIP(host) == nil && strings.Contains(host, ".") {
+		if d, err := publicsuffix.EffectiveTLDPlusOne(host); err == nil {
+			return d, nil
+		}
+	}
+	return strings.TrimPrefix(joinHost(host, u.Port()), "www."), nil
+}
+
+// Host returns a host name, port and all if it has one, in the one form it
+// is compared and stored in: lower case, no trailing dot, and international
+// names in punycode, "xn--fiqs8s.cn" for both "中国.cn" and "XN--FIQS8S.cn".
+func Host(host string) (ascii string, err error) {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "" {
+		return "", ErrNoHost
+	}
+	if ascii, err = idna.ToASCII(host); err != nil {
+		return
+	}
+	// Punycode labels that do not decode are not host names
+	_, err = idna.ToUnicode(ascii)
+	return
+}
+
+// joinHost puts a host name and port, if any, back together.
+func joinHost(host, port string) string {
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if port != "" {
+		host += ":" + port
+	}
+	return host
+}
+
+// Display returns the Unicode form of a host or domain name for people to
+// read, or name itself if it is not valid punycode.
+func Display(name string) string {
+	if u, err := idna.ToUnicode(name); err == nil {
+		return u
+	}
+	return name
+}
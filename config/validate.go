@@ -0,0 +1,50 @@
+package config
+
+import (
+	"domain"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrDuplicate = errors.New("Duplicate domain")
+
+// Errors lists every problem Validate found.
+type Errors []error
+
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i := range e {
+		msgs[i] = e[i].Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Validate checks every domain of c, see domain.Domain.Validate, and that no
+// two of them share a URL or a name. The error is an Errors if not nil.
+func (c *Config) Validate() error {
+	var errs Errors
+	seen := make(map[string]string, len(c.Domains))
+	for i := range c.Domains {
+		d := &c.Domains[i]
+		errs = append(errs, d.Validate()...)
+		// Malformed URLs have no domain name, Validate reported them
+		if d.Domain() == "" {
+			continue
+		}
+		if first, ok := seen[d.Domain()]; ok {
+			errs = append(errs, &domain.ConfigError{
+				Domain: d.URL,
+				Field:  "URL",
+				Value:  d.URL,
+				Err:    fmt.Errorf("%s of %s, both are %s", ErrDuplicate, first, d.Domain()),
+			})
+			continue
+		}
+		seen[d.Domain()] = d.URL
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package config
+
+import (
+	"domain"
+	"launchpad.net/gocheck"
+	"testing"
+)
+
+type ConfigSuite struct{}
+
+var _ = gocheck.Suite(new(ConfigSuite))
+
+func Test(t *testing.T) { gocheck.TestingT(t) }
+
+func (s *ConfigSuite) TestValidate(c *gocheck.C) {
+	cfg := &Config{Domains: []domain.Domain{
+		{URL: "http://www.moko.cc/"},
+		{URL: "http://[::1"},
+		{URL: "http://xn--99999999999.cn/"},
+		{URL: "http://img.moko.cc/"},
+	}}
+	err := cfg.Validate()
+	c.Assert(err, gocheck.FitsTypeOf, Errors{})
+	// One per malformed URL, and the duplicate; the malformed ones are not
+	// duplicates of each other
+	c.Check(err.(Errors), gocheck.HasLen, 3)
+
+	cfg.Domains = cfg.Domains[:1]
+	c.Check(cfg.Validate(), gocheck.IsNil)
+}
@@ -0,0 +1,49 @@
+package cron
+
+import (
+	"launchpad.net/gocheck"
+	"testing"
+	"time"
+)
+
+type CronSuite struct{}
+
+var _ = gocheck.Suite(new(CronSuite))
+
+func Test(t *testing.T) { gocheck.TestingT(t) }
+
+func (s *CronSuite) TestNext(c *gocheck.C) {
+	// A Saturday
+	from := time.Date(2024, 6, 1, 12, 30, 45, 0, time.UTC)
+	tests := map[string]time.Time{
+		"* * * * *":         time.Date(2024, 6, 1, 12, 31, 0, 0, time.UTC),
+		"*/15 * * * *":      time.Date(2024, 6, 1, 12, 45, 0, 0, time.UTC),
+		"0 3 * * *":         time.Date(2024, 6, 2, 3, 0, 0, 0, time.UTC),
+		"@daily":            time.Date(2024, 6, 2, 0, 0, 0, 0, time.UTC),
+		"0 22 * * mon-fri":  time.Date(2024, 6, 3, 22, 0, 0, 0, time.UTC),
+		"0 0 * * 7":         time.Date(2024, 6, 2, 0, 0, 0, 0, time.UTC),
+		"0 9 1,15 * *":      time.Date(2024, 6, 15, 9, 0, 0, 0, time.UTC),
+		"0 9 15 * mon":      time.Date(2024, 6, 3, 9, 0, 0, 0, time.UTC),
+		"30 1 29 feb *":     time.Date(2028, 2, 29, 1, 30, 0, 0, time.UTC),
+		"0 0 30 2 *":        time.Time{},
+		"0 12-14/2 * JUN *": time.Date(2024, 6, 1, 14, 0, 0, 0, time.UTC),
+		"@weekly":           time.Date(2024, 6, 2, 0, 0, 0, 0, time.UTC),
+	}
+	for expr, exp := range tests {
+		sch, err := Parse(expr)
+		c.Assert(err, gocheck.IsNil, gocheck.Commentf(expr))
+		c.Check(sch.Next(from), gocheck.DeepEquals, exp, gocheck.Commentf(expr))
+	}
+
+	shanghai, err := time.LoadLocation("Asia/Shanghai")
+	c.Assert(err, gocheck.IsNil)
+	sch, _ := Parse("0 3 * * *")
+	c.Check(sch.Next(from.In(shanghai)).Equal(time.Date(2024, 6, 1, 19, 0, 0, 0, time.UTC)), gocheck.Equals, true)
+}
+
+func (s *CronSuite) TestParse(c *gocheck.C) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8", "*/0 * * * *", "5-1 * * * *", "* * * * funday"} {
+		_, err := Parse(expr)
+		c.Check(err, gocheck.NotNil, gocheck.Commentf(expr))
+	}
+}
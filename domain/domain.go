@@ -1,13 +1,14 @@
 package domain
 
 import (
-	_ "download"
+	"canon"
+	"download"
 	"errors"
-	"github.com/temoto/robotstxt-go"
+	"logger"
+	"login"
 	"net/url"
 	"page"
 	"regexp"
-	"strings"
 	"time"
 )
 
@@ -19,40 +20,120 @@ type Domain struct {
 	StartPoints []string      // Paths to begin when link-spidering completes
 	Delay       time.Duration // Delay between GETs to domain (15s)
 	Redownload  time.Duration // Delay between re-downloading pages (3hr)
+	Options                   // Everything else, stored as one JSON document
 	domainName  string
-	robotRules  *robotstxt.Group
+	fetcher     download.Fetcher
+	proxies     *download.ProxyPool
+	jar         *download.Jar
 	url         *url.URL
 	reExclude   []*regexp.Regexp
 	reInclude   []*regexp.Regexp
+	rules       []*rule
 }
 
+// Options holds the per-domain settings that storage backends keep as a
+// single JSON document rather than in columns of their own. Zero values mean
+// "use the default".
+type Options struct {
+	Retries       int           // Attempts per page before it is marked failed, see download.DefaultRetryPolicy
+	Proxies       []string      // Proxy URLs (http://, socks5://) to spread requests over
+	ProxyRotation string        // "sticky" stays on one proxy until it fails, otherwise round-robin
+	MaxBodySize   int64         // Bytes, see download.DefaultMaxBodySize; -1 for no limit
+	ContentTypes  []string      // Media types worth downloading, see download.DefaultContentTypes
+	Preflight     bool          // Send a HEAD first to skip large or unwanted bodies early
+	Bandwidth     int64         // Bytes per second to read bodies at, 0 for no limit
+	Sitemap       []string      // Sitemap URLs to seed from besides those in robots.txt
+	SitemapEvery  time.Duration // How often to read the sitemaps again, see DefaultSitemapEvery
+	Canon         canon.Rules   // Query parameters to strip or keep when canonicalizing URLs
+	Scope         string        // Links to follow, see ScopeHost and friends
+	Hosts         []string      // Hosts to follow links to under ScopeHosts
+	MaxDepth      int           // Links to follow away from the start points, 0 for no limit
+	MaxPages      int           // Pages to crawl per pass, 0 for no limit
+	MaxDuration   time.Duration // Time a pass may take, 0 for no limit
+	Rules         []Rule        // Include and exclude rules on top of Include and Exclude
+	Windows       []Window      // Times of the week crawling is allowed in, any time if empty
+	Schedule      string        // Cron expression for when passes begin, see package cron; passes follow each other if empty
+	TimeZone      string        // IANA name Windows and Schedule are in, UTC if empty
+	AdaptiveDelay bool          // Move the delay with how the server copes, starting at Delay, see Observe
+	MinDelay      time.Duration // Floor of the adaptive delay
+	MaxDelay      time.Duration // Ceiling of the adaptive delay, see DefaultMaxDelay
+	MinRecrawl    time.Duration // Shortest time between downloads of a page, Redownload if 0
+	MaxRecrawl    time.Duration // Longest time between downloads of a page, see DefaultMaxRecrawl
+	Traps         TrapLimits    // When links look like a crawler trap, see CheckTrap
+	HTTP          download.Profile
+	Login         login.Config // Form login to run before crawling, if Login.URL is set
+}
+
+// Scopes, deciding which links of a domain's pages are followed. Pages are
+// stored under the domain of their own URL, so under ScopeExternal every site
+// linked to gets storage of its own: with the sqlite backend, one database
+// file per external domain.
+const (
+	ScopeHost     = "host"     // Same host as the domain URL, the default
+	ScopeDomain   = "domain"   // Same registrable domain, subdomains included
+	ScopeHosts    = "hosts"    // The domain's host and those listed in Hosts
+	ScopeExternal = "external" // Like ScopeDomain, plus other links fetched for their status only
+)
+
+// DefaultSitemapEvery is how often sitemaps are read for domains that do not
+// set SitemapEvery.
+const DefaultSitemapEvery = 24 * time.Hour
+
 var (
 	ErrTooSoon      = errors.New("Too soon to redownload")
 	ErrRobot        = errors.New("Robots.txt denied access")
+	ErrRobotsDown   = errors.New("Robots.txt temporarily unavailable")
 	ErrRegexExclude = errors.New("Excludes regexp matched")
 	ErrRegexInclude = errors.New("Includes regexp did not match")
 )
 
-func FromURL(rawurl string) (name string) {
-	u, _ := url.Parse(rawurl)
-	if strings.HasPrefix(u.Host, "www.") {
-		u.Host = u.Host[4:]
-	}
-	return u.Host
+// FromURL returns the name of the domain rawurl belongs to, its registrable
+// domain in ASCII, see canon.Registrable. URLs without a valid host return an
+// error.
+func FromURL(rawurl string) (name string, err error) {
+	return canon.Registrable(rawurl)
 }
 
 // Performs a few checks to determine if this page should be downloaded. Checks
 // include:
-// - Check if page last download is within the Redownload duration
-// - Check if robots.txt blocks the page
-// - Check if the page's URL is in the Exclude list
-func (d *Domain) CanDownload(p *page.Page) (err error) {
+// - Check if the page is not due yet (see Reschedule), or has no due time and
+// was last downloaded within the Redownload duration
+// - Check if robots.txt blocks the page, or could not be fetched
+// - Check if the page's URL is in the Exclude list, or excluded by Rules
+func (d *Domain) CanDownload(p *page.Page) error {
+	return d.check(p, true)
+}
 
-	return nil
-	if p.LastDownload.After(time.Now().Add(-d.Redownload)) {
+// CanQueue is CanDownload without robots.txt, for links found on pages:
+// robots.txt of a new host is fetched when its pages come out of the queue,
+// not while the links to them go in.
+func (d *Domain) CanQueue(p *page.Page) error {
+	return d.check(p, false)
+}
+
+func (d *Domain) check(p *page.Page, robots bool) (err error) {
+	switch {
+	case !p.NextDownload.IsZero():
+		if p.NextDownload.After(time.Now()) {
+			return ErrTooSoon
+		}
+	case p.LastDownload.After(time.Now().Add(-d.Redownload)):
 		return ErrTooSoon
 	}
 
+	// Only fetched for its status, the domain's path rules are not about it
+	// but the robots.txt of its host is
+	u, err := p.GetURL()
+	if err != nil {
+		return
+	}
+	if d.Scope == ScopeExternal && !d.InScope(p.URL) {
+		if robots {
+			return d.checkRobots(u)
+		}
+		return nil
+	}
+
 	// StartPoint check
 	for i := range d.StartPoints {
 		if d.StartPoints[i] == p.URL {
@@ -60,12 +141,16 @@ func (d *Domain) CanDownload(p *page.Page) (err error) {
 		}
 	}
 
-	path := p.GetURL().Path
+	path := u.Path
 
 	if d.reInclude == nil || d.reExclude == nil {
 		d.UpdateRegexpRules()
 	}
 
+	if err = d.checkRules(p.URL, u); err != nil {
+		return
+	}
+
 	if len(d.Include) > 0 {
 		include := false
 		for i := range d.reInclude {
@@ -78,11 +163,10 @@ func (d *Domain) CanDownload(p *page.Page) (err error) {
 		}
 	}
 
-	if d.robotRules == nil {
-		d.UpdateRobotRules()
-	}
-	if !d.robotRules.Test(path) {
-		return ErrRobot
+	if robots {
+		if err = d.checkRobots(u); err != nil {
+			return
+		}
 	}
 
 	for i := range d.reExclude {
@@ -94,27 +178,189 @@ func (d *Domain) CanDownload(p *page.Page) (err error) {
 	return nil
 }
 
+// InScope reports whether links to rawurl are followed, and the page found
+// there crawled for more links. rawurl is judged in canonical form, so case,
+// default ports and international names make no difference.
+func (d *Domain) InScope(rawurl string) bool {
+	u, err := url.Parse(d.Canonical(rawurl))
+	if err != nil {
+		return false
+	}
+	host, err := canon.Host(u.Host)
+	if err != nil {
+		return false
+	}
+	switch d.Scope {
+	case ScopeDomain, ScopeExternal:
+		name, err := FromURL(rawurl)
+		return err == nil && name == d.Domain()
+	case ScopeHosts:
+		for _, h := range d.Hosts {
+			if h, err := canon.Host(h); err == nil && h == host {
+				return true
+			}
+		}
+	}
+	return host == d.GetURL().Host
+}
+
+// Follows reports whether a link to rawurl found on the domain's pages is
+// queued at all: those InScope, and under ScopeExternal all others too.
+func (d *Domain) Follows(rawurl string) bool {
+	return d.Scope == ScopeExternal || d.InScope(rawurl)
+}
+
+// Canonical returns rawurl in canonical form under the domain's rules, see
+// package canon. URLs that do not parse are returned as they are.
+func (d *Domain) Canonical(rawurl string) string {
+	if c, err := canon.URL(rawurl, d.Canon); err == nil {
+		return c
+	}
+	return rawurl
+}
+
+// Domain returns the name of the domain, see FromURL. It is empty if URL is
+// malformed, which Validate reports.
 func (d *Domain) Domain() (domainName string) {
 	if d.domainName == "" {
-		d.domainName = FromURL(d.URL)
+		d.domainName, _ = FromURL(d.URL)
 	}
 	return d.domainName
 }
 
+// DisplayName returns Domain with international names in Unicode, for
+// people to read.
+func (d *Domain) DisplayName() string {
+	return canon.Display(d.Domain())
+}
+
+// Fetcher returns the Fetcher this domain's pages are downloaded with. It is
+// created on first use and keeps the domain's session in Jar.
+func (d *Domain) Fetcher() (f download.Fetcher, err error) {
+	if d.fetcher == nil {
+		var opts download.Options
+		if opts, err = d.options(); err != nil {
+			return
+		}
+		d.fetcher, err = download.New("", opts)
+	}
+	return d.fetcher, err
+}
+
+// RetryDelay reports whether a page whose attempt-th download failed with
+// err is tried again, and how long after. Only temporary failures are, see
+// download.Temporary, and ErrRobotsDown, up to Retries attempts. Pages are not retried within
+// Fetcher, that would hold up the crawl of every domain; the scheduler
+// queues them again instead.
+func (d *Domain) RetryDelay(p *page.Page, attempt int, err error) (delay time.Duration, ok bool) {
+	policy := download.DefaultRetryPolicy
+	if d.Retries > 0 {
+		policy.MaxAttempts = d.Retries
+	}
+	if _, status := err.(*page.StatusError); status {
+		// Up to the status code
+		err = nil
+	}
+	if attempt >= policy.MaxAttempts {
+		return 0, false
+	}
+	if err == ErrRobotsDown {
+		// Asked for again once RobotsRetry passed
+		return RobotsRetry, true
+	}
+	resp := p.Response()
+	if !download.Temporary(resp, err) {
+		return 0, false
+	}
+	if err == download.ErrNoProxy && d.proxies != nil {
+		// Nothing was sent, wait for a proxy to come back
+		if wait := d.proxies.Cooldown(); wait > 0 {
+			return wait, true
+		}
+	}
+	if delay, ok = policy.Delay(attempt, resp); !ok {
+		logger.Warn.Printf("%s asked to retry after more than %s, giving up", p.URL, policy.MaxDelay)
+	}
+	return
+}
+
+// options turns the domain's settings into download.Options.
+func (d *Domain) options() (opts download.Options, err error) {
+	opts = download.Options{
+		Profile:      d.HTTP,
+		Jar:          d.Jar(),
+		MaxBodySize:  d.MaxBodySize,
+		ContentTypes: d.ContentTypes,
+		Preflight:    d.Preflight,
+		Bandwidth:    download.Bandwidth(d.Domain(), d.Bandwidth),
+	}
+	switch {
+	case d.MaxBodySize == 0:
+		opts.MaxBodySize = download.DefaultMaxBodySize
+	case d.MaxBodySize < 0:
+		opts.MaxBodySize = 0
+	}
+	if len(d.ContentTypes) == 0 {
+		opts.ContentTypes = download.DefaultContentTypes
+	}
+	if len(d.Proxies) > 0 && d.proxies == nil {
+		d.proxies, err = download.NewProxyPool(d.Proxies, d.ProxyRotation == "sticky")
+	}
+	opts.Proxies = d.proxies
+	return
+}
+
+// LogIn signs in with the domain's login flow, if it has one. The session
+// lands in Jar and is used by Fetcher from then on.
+func (d *Domain) LogIn() (err error) {
+	if d.Login.URL == "" {
+		return
+	}
+	f, err := d.Fetcher()
+	if err != nil {
+		return
+	}
+	return login.Login(f, d.Login)
+}
+
+// Jar returns the cookie jar holding this domain's session.
+func (d *Domain) Jar() *download.Jar {
+	if d.jar == nil {
+		d.jar = download.NewJar()
+	}
+	return d.jar
+}
+
+// GetURL returns URL parsed in canonical form, see Canonical. A malformed
+// URL gives an empty one.
 func (d *Domain) GetURL() *url.URL {
 	if d.url != nil {
 		return d.url
 	}
-	d.url, _ = url.Parse(d.URL)
-	if d.url.Path == "" {
-		d.url.Path = "/"
+	u, err := url.Parse(d.Canonical(d.URL))
+	if err != nil {
+		u = new(url.URL)
+	}
+	if u.Path == "" {
+		u.Path = "/"
 	}
+	d.url = u
 	return d.url
 }
 
+// CanonicalStartPoints puts StartPoints in canonical form, see Canonical,
+// the form pages are queued and stored in.
+func (d *Domain) CanonicalStartPoints() {
+	for i := range d.StartPoints {
+		d.StartPoints[i] = d.Canonical(d.StartPoints[i])
+	}
+}
+
+// IsStartPoint reports whether s, in canonical form, is one of StartPoints,
+// or the domain's URL if it has none.
 func (d *Domain) IsStartPoint(s string) bool {
 	if len(d.StartPoints) == 0 {
-		return d.GetURL().String() == s
+		return d.Canonical(d.GetURL().String()) == s
 	}
 	for i := range d.StartPoints {
 		if d.StartPoints[i] == s {
@@ -124,37 +370,34 @@ func (d *Domain) IsStartPoint(s string) bool {
 	return false
 }
 
+// UpdateRegexpRules compiles Include, Exclude and Rules. Rules that do not
+// compile are left out and logged, Validate reports them before they get
+// this far.
 func (d *Domain) UpdateRegexpRules() {
-	d.reExclude = d.buildRegexp(d.Exclude)
-	d.reInclude = d.buildRegexp(d.Include)
+	var errs []error
+	d.rules, errs = d.buildRules()
+	for _, err := range errs {
+		logger.Error.Print(err)
+	}
+	d.reExclude, errs = d.buildRegexp("Exclude", d.Exclude)
+	for _, err := range errs {
+		logger.Error.Print(err)
+	}
+	d.reInclude, errs = d.buildRegexp("Include", d.Include)
+	for _, err := range errs {
+		logger.Error.Print(err)
+	}
 }
 
-func (d *Domain) buildRegexp(in []string) (out []*regexp.Regexp) {
-	out = make([]*regexp.Regexp, len(in))
+func (d *Domain) buildRegexp(field string, in []string) (out []*regexp.Regexp, errs []error) {
+	out = make([]*regexp.Regexp, 0, len(in))
 	for i := range in {
-		out[i] = regexp.MustCompile(in[i])
+		re, err := regexp.Compile(in[i])
+		if err != nil {
+			errs = append(errs, &ConfigError{Domain: d.URL, Field: field, Value: in[i], Err: err})
+			continue
+		}
+		out = append(out, re)
 	}
 	return
 }
-
-func (d *Domain) UpdateRobotRules() {
-	/*
-			var robots *robotstxt.RobotsData
-			u := d.GetURL().ResolveReference(&url.URL{Path: "/robots.txt"}).String()
-			resp, err := download.Get(u)
-			if err != nil {
-				goto AllowAll
-			}
-			defer resp.Body.Close()
-			robots, err = robotstxt.FromResponse(resp)
-			if err != nil {
-				goto AllowAll
-			}
-			d.robotRules = robots.FindGroup(download.BotName)
-			return
-
-		AllowAll:
-			robots = &robotstxt.RobotsData{}
-			d.robotRules = robots.FindGroup(download.BotName)
-	*/
-}
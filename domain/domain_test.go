@@ -1,9 +1,15 @@
 package domain
 
 import (
+	"download"
+	"fmt"
 	"launchpad.net/gocheck"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"page"
 	"samplesite"
+	"strings"
 	"testing"
 	"time"
 )
@@ -27,15 +33,125 @@ func (s *DomainSuite) TestRobotsTxt(c *gocheck.C) {
 	}
 }
 
+func (s *DomainSuite) TestRobotsStatus(c *gocheck.C) {
+	defer func(retry time.Duration) { RobotsRetry = retry }(RobotsRetry)
+	RobotsRetry = 0
+
+	var hits, status int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			hits++
+			w.WriteHeader(status)
+			fmt.Fprint(w, "User-agent: *\nDisallow: /\n")
+		}
+	}))
+	defer ts.Close()
+	d := &Domain{URL: ts.URL}
+	p := &page.Page{URL: ts.URL + "/page"}
+
+	// Denied until the server recovers
+	status = http.StatusServiceUnavailable
+	c.Check(d.CanDownload(p), gocheck.Equals, ErrRobotsDown)
+	delay, ok := d.RetryDelay(p, 1, ErrRobotsDown)
+	c.Check(ok, gocheck.Equals, true)
+	c.Check(delay, gocheck.Equals, RobotsRetry)
+	_, ok = d.RetryDelay(p, download.DefaultRetryPolicy.MaxAttempts, ErrRobotsDown)
+	c.Check(ok, gocheck.Equals, false)
+	status = http.StatusNotFound
+	c.Check(d.CanDownload(p), gocheck.Equals, nil)
+	c.Check(hits, gocheck.Equals, 2)
+
+	// Cached from now on
+	status = http.StatusOK
+	c.Check(d.CanDownload(p), gocheck.Equals, nil)
+	c.Check(hits, gocheck.Equals, 2)
+	d.UpdateRobotRules()
+	c.Check(d.CanDownload(p), gocheck.Equals, ErrRobot)
+	c.Check(hits, gocheck.Equals, 3)
+
+	// Queueing leaves robots.txt alone
+	d = &Domain{URL: ts.URL}
+	c.Check(d.CanQueue(p), gocheck.Equals, nil)
+	c.Check(hits, gocheck.Equals, 3)
+}
+
+func (s *DomainSuite) TestRobotsHost(c *gocheck.C) {
+	server := func(disallow string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "User-agent: *\nDisallow: %s\n", disallow)
+		}))
+	}
+	own, other := server("/a"), server("/b?q=")
+	defer own.Close()
+	defer other.Close()
+	u, _ := url.Parse(other.URL)
+
+	// Each host is held to its own robots.txt
+	d := &Domain{URL: own.URL, Options: Options{Scope: ScopeHosts, Hosts: []string{u.Host}}}
+	c.Check(d.CanDownload(&page.Page{URL: own.URL + "/a"}), gocheck.Equals, ErrRobot)
+	c.Check(d.CanDownload(&page.Page{URL: own.URL + "/b"}), gocheck.IsNil)
+	c.Check(d.CanDownload(&page.Page{URL: other.URL + "/a"}), gocheck.IsNil)
+	c.Check(d.CanDownload(&page.Page{URL: other.URL + "/b"}), gocheck.IsNil)
+	c.Check(d.CanDownload(&page.Page{URL: other.URL + "/b?page=2"}), gocheck.IsNil)
+	c.Check(d.CanDownload(&page.Page{URL: other.URL + "/b?q=moko"}), gocheck.Equals, ErrRobot)
+
+	// Also when only fetched for the status
+	d.Scope = ScopeExternal
+	c.Check(d.InScope(other.URL+"/b"), gocheck.Equals, false)
+	c.Check(d.CanDownload(&page.Page{URL: other.URL + "/b?q=moko"}), gocheck.Equals, ErrRobot)
+	c.Check(d.CanDownload(&page.Page{URL: other.URL + "/a"}), gocheck.IsNil)
+}
+
+func (s *DomainSuite) TestCrawlDelay(c *gocheck.C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, "Sitemap: /sitemap.xml\n\nUser-agent: GoSpiderBot\nCrawl-delay: 20\nDisallow: /private\n")
+	}))
+	defer ts.Close()
+
+	d := &Domain{URL: ts.URL, Delay: 15 * time.Second}
+	c.Check(d.CrawlDelay(), gocheck.Equals, 20*time.Second)
+	d.Delay = time.Minute
+	c.Check(d.CrawlDelay(), gocheck.Equals, time.Minute)
+	c.Check(d.Sitemaps(), gocheck.DeepEquals, []string{ts.URL + "/sitemap.xml"})
+	c.Check(d.CanDownload(&page.Page{URL: ts.URL + "/private/1"}), gocheck.Equals, ErrRobot)
+}
+
+func (s *DomainSuite) TestValidate(c *gocheck.C) {
+	d := &Domain{
+		URL:         "http://example.com/",
+		StartPoints: []string{"http://example.com/a", "http://other.com/", "example.com/b"},
+		Exclude:     []string{"^/ok", "(unclosed"},
+		Include:     []string{"[z-a]"},
+	}
+	errs := d.Validate()
+	c.Assert(errs, gocheck.HasLen, 4)
+	c.Check(errs[0].(*ConfigError).Value, gocheck.Equals, "http://other.com/")
+	c.Check(errs[0].(*ConfigError).Err, gocheck.Equals, ErrOutside)
+	c.Check(errs[1].(*ConfigError).Err, gocheck.Equals, ErrNotHTTP)
+	c.Check(errs[2].(*ConfigError).Field, gocheck.Equals, "Exclude")
+	c.Check(errs[3].(*ConfigError).Field, gocheck.Equals, "Include")
+
+	// Bad rules are skipped rather than panicking
+	d.UpdateRegexpRules()
+	c.Check(d.reExclude, gocheck.HasLen, 1)
+	c.Check(d.reInclude, gocheck.HasLen, 0)
+
+	c.Check((&Domain{URL: "example.com"}).Validate(), gocheck.HasLen, 1)
+	c.Check((&Domain{URL: samplesite.URL}).CheckReachable(), gocheck.IsNil)
+	c.Check((&Domain{URL: "http://127.0.0.1:1/"}).CheckReachable(), gocheck.NotNil)
+}
+
 func (s *DomainSuite) TestExcludeRegexp(c *gocheck.C) {
 	d := &Domain{
 		Exclude: []string{
 			"^/cont",
 		},
 	}
+	// robots.txt of the page's host applies even without a domain URL
 	tests := map[*page.Page]bool{
 		&page.Page{URL: samplesite.URL + "/"}:         true,
-		&page.Page{URL: samplesite.URL + "/nospider"}: true,
+		&page.Page{URL: samplesite.URL + "/nospider"}: false,
 		&page.Page{URL: samplesite.URL + "/article1"}: true,
 		&page.Page{URL: samplesite.URL + "/contact"}:  false,
 	}
@@ -85,13 +201,373 @@ func (s *DomainSuite) TestIn_Exclude(c *gocheck.C) {
 	}
 }
 
+func (s *DomainSuite) TestRules(c *gocheck.C) {
+	d := &Domain{
+		URL: "http://example.com/",
+		Options: Options{Rules: []Rule{
+			{Action: RuleExclude, Target: TargetParam, Param: "sort", Match: MatchPrefix},
+			{Action: RuleExclude, Target: TargetURL, Pattern: `zmAction|forward\.action\?actionkey=`},
+			{Action: RuleInclude, Target: TargetHost, Match: MatchGlob, Pattern: "*.example.com"},
+			{Action: RuleInclude, Target: TargetQuery, Match: MatchPrefix, Pattern: "page=", Priority: 1},
+			{Action: RuleExclude, Target: TargetHost, Pattern: "^admin\\."},
+		}},
+	}
+	d.UpdateRegexpRules()
+	tests := map[string]error{
+		"http://www.example.com/a":                          nil,
+		"http://www.example.com/a?sort=desc":                ErrRuleExclude,
+		"http://www.example.com/a?sortby=desc":              nil,
+		"http://www.example.com/forward.action?actionkey=1": ErrRuleExclude,
+		"http://blog.example.com/zmAction/1":                ErrRuleExclude,
+		"http://example.com/a":                              ErrRuleInclude,
+		"http://example.com/a?page=2&sort=desc":             nil, // Priority wins
+		"http://admin.example.com/":                         nil, // Include listed first
+	}
+	for u, exp := range tests {
+		parsed, err := (&page.Page{URL: u}).GetURL()
+		c.Assert(err, gocheck.IsNil)
+		c.Check(d.checkRules(u, parsed), gocheck.Equals, exp, gocheck.Commentf(u))
+	}
+
+	d.Rules = append(d.Rules, Rule{Action: "drop"}, Rule{Action: RuleExclude, Target: TargetParam}, Rule{Action: RuleExclude, Match: "regex"})
+	errs := d.Validate()
+	c.Assert(errs, gocheck.HasLen, 3)
+	c.Check(errs[0].(*ConfigError).Err, gocheck.Equals, ErrRuleAction)
+	c.Check(errs[1].(*ConfigError).Err, gocheck.Equals, ErrRuleParam)
+	c.Check(errs[2].(*ConfigError).Err, gocheck.Equals, ErrRuleMatch)
+}
+
+func (s *DomainSuite) TestWindow(c *gocheck.C) {
+	d := &Domain{Options: Options{
+		TimeZone: "Asia/Shanghai",
+		Windows: []Window{
+			{Days: []string{"mon", "tue", "wed", "thu", "fri"}, Start: "22:00", End: "06:00"},
+			{Days: []string{"Sat"}, Start: "10:00", End: "12:00"},
+		},
+		Schedule: "0 22 * * mon",
+	}}
+	loc := d.Location()
+	tests := map[time.Time]time.Time{
+		time.Date(2024, 6, 3, 23, 0, 0, 0, loc):     time.Date(2024, 6, 3, 23, 0, 0, 0, loc), // Monday night
+		time.Date(2024, 6, 4, 5, 59, 0, 0, loc):     time.Date(2024, 6, 4, 5, 59, 0, 0, loc),
+		time.Date(2024, 6, 4, 6, 0, 0, 0, loc):      time.Date(2024, 6, 4, 22, 0, 0, 0, loc),
+		time.Date(2024, 6, 8, 5, 0, 0, 0, loc):      time.Date(2024, 6, 8, 5, 0, 0, 0, loc), // Friday's window
+		time.Date(2024, 6, 8, 6, 0, 0, 0, loc):      time.Date(2024, 6, 8, 10, 0, 0, 0, loc),
+		time.Date(2024, 6, 8, 12, 0, 0, 0, loc):     time.Date(2024, 6, 10, 22, 0, 0, 0, loc),
+		time.Date(2024, 6, 8, 3, 0, 0, 0, time.UTC): time.Date(2024, 6, 8, 3, 0, 0, 0, time.UTC), // 11:00 in Shanghai
+	}
+	for t, exp := range tests {
+		c.Check(d.NextWindow(t).Equal(exp), gocheck.Equals, true, gocheck.Commentf("%s: %s", t, d.NextWindow(t)))
+		c.Check(d.InWindow(t), gocheck.Equals, t.Equal(exp), gocheck.Commentf("%s", t))
+	}
+	c.Check(d.NextPass(time.Date(2024, 6, 3, 23, 0, 0, 0, loc)).Equal(time.Date(2024, 6, 10, 22, 0, 0, 0, loc)), gocheck.Equals, true)
+	c.Check((&Domain{}).InWindow(time.Now()), gocheck.Equals, true)
+	c.Check((&Domain{}).NextPass(time.Now()).IsZero(), gocheck.Equals, true)
+
+	d.URL = "http://example.com/"
+	d.TimeZone = "Mars/Olympus_Mons"
+	d.Windows = []Window{{Days: []string{"someday"}, Start: "25:00", End: "6"}}
+	d.Schedule = "every day"
+	c.Check(d.Validate(), gocheck.HasLen, 5)
+}
+
+func (s *DomainSuite) TestAdaptiveDelay(c *gocheck.C) {
+	d := &Domain{URL: samplesite.URL, Delay: 10 * time.Second}
+	d.AdaptiveDelay, d.MinDelay, d.MaxDelay = true, 2*time.Second, time.Minute
+	delete(pacers, d.Domain())
+	ok := func(latency time.Duration, header ...string) *download.Response {
+		resp := &download.Response{StatusCode: 200, Header: make(http.Header)}
+		resp.Timing.Total = latency
+		for i := 0; i < len(header); i += 2 {
+			resp.Header.Set(header[i], header[i+1])
+		}
+		return resp
+	}
+	c.Check(d.CrawlDelay(), gocheck.Equals, 10*time.Second)
+
+	// Healthy, down to the floor
+	for i := 0; i < 30; i++ {
+		d.Observe(ok(100 * time.Millisecond))
+	}
+	c.Check(d.CrawlDelay(), gocheck.Equals, 2*time.Second)
+
+	d.Observe(&download.Response{StatusCode: 503, Header: make(http.Header)})
+	c.Check(d.CrawlDelay(), gocheck.Equals, 4*time.Second)
+	d.Observe(nil)
+	c.Check(d.CrawlDelay(), gocheck.Equals, 8*time.Second)
+	d.Observe(&download.Response{StatusCode: 429, Header: http.Header{"Retry-After": {"30"}}})
+	c.Check(d.CrawlDelay(), gocheck.Equals, 30*time.Second)
+	d.Observe(ok(100*time.Millisecond, "X-RateLimit-Remaining", "0"))
+	c.Check(d.CrawlDelay(), gocheck.Equals, time.Minute)
+
+	d.Observe(ok(100*time.Millisecond, "X-RateLimit-Remaining", "50", "X-RateLimit-Limit", "100"))
+	c.Check(d.CrawlDelay(), gocheck.Equals, 54*time.Second)
+	d.Observe(ok(100*time.Millisecond, "X-RateLimit-Remaining", "5", "X-RateLimit-Limit", "100"))
+	c.Check(d.CrawlDelay(), gocheck.Equals, time.Minute)
+	d.Observe(ok(100 * time.Millisecond))
+	c.Check(d.CrawlDelay(), gocheck.Equals, 54*time.Second)
+	// Twice as slow as usual
+	d.Observe(ok(time.Second))
+	c.Check(d.CrawlDelay(), gocheck.Equals, time.Minute)
+
+	stats := Delays()[d.Domain()]
+	c.Check(stats.Delay, gocheck.Equals, time.Minute)
+	c.Check(stats.Throttled, gocheck.Equals, int64(6))
+
+	// A Retry-After date in the past asks for no wait of its own
+	d.RestoreDelay(4 * time.Second)
+	past := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+	d.Observe(&download.Response{StatusCode: 503, Header: http.Header{"Retry-After": {past}}})
+	c.Check(d.CrawlDelay(), gocheck.Equals, 8*time.Second)
+
+	// Saved and restored across runs, within the bounds
+	c.Check(d.DelayChanged(), gocheck.Equals, true)
+	c.Check(d.AdaptedDelay(), gocheck.Equals, 8*time.Second)
+	c.Check(d.DelayChanged(), gocheck.Equals, false)
+	d.RestoreDelay(time.Hour)
+	c.Check(d.CrawlDelay(), gocheck.Equals, time.Minute)
+	c.Check(d.DelayChanged(), gocheck.Equals, false)
+	d.RestoreDelay(10 * time.Second)
+	d.Observe(nil)
+	c.Check(d.DelayChanged(), gocheck.Equals, true)
+
+	// Off, the delay stays put
+	d2 := &Domain{URL: samplesite.URL, Delay: 10 * time.Second}
+	d2.Observe(nil)
+	c.Check(d2.CrawlDelay(), gocheck.Equals, 10*time.Second)
+
+	d.MinDelay = 2 * time.Minute
+	c.Check(d.Validate(), gocheck.HasLen, 1)
+}
+
+func (s *DomainSuite) TestReschedule(c *gocheck.C) {
+	d := &Domain{Redownload: 3 * time.Hour}
+	d.MinRecrawl, d.MaxRecrawl = time.Hour, 7*24*time.Hour
+	start := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	fetch := func(p *page.Page, at time.Time, changed bool) {
+		p.LastDownload = at
+		if changed {
+			p.LastModified = at
+		}
+		if p.FirstDownload.IsZero() {
+			p.FirstDownload = at
+		}
+		d.Reschedule(p)
+	}
+
+	// Changes every time it is looked at, down to MinRecrawl
+	index := new(page.Page)
+	fetch(index, start, true)
+	c.Check(index.Interval, gocheck.Equals, 3*time.Hour)
+	c.Check(index.NextDownload, gocheck.Equals, start.Add(3*time.Hour))
+	for i := 0; i < 4; i++ {
+		fetch(index, index.NextDownload, true)
+	}
+	c.Check(index.Interval, gocheck.Equals, time.Hour)
+	c.Check(index.Changes, gocheck.Equals, 4)
+
+	// Never changes, up to MaxRecrawl
+	album := new(page.Page)
+	fetch(album, start, true)
+	for i := 0; i < 10; i++ {
+		fetch(album, album.NextDownload, false)
+	}
+	c.Check(album.Interval, gocheck.Equals, 7*24*time.Hour)
+	c.Check(album.Changes, gocheck.Equals, 0)
+
+	// Changes at midnight, settles on checking a few times a day
+	daily := new(page.Page)
+	fetch(daily, start, true)
+	for i := 1; i <= 40; i++ {
+		at := daily.NextDownload
+		midnight := at.Truncate(24 * time.Hour)
+		fetch(daily, at, midnight.After(daily.LastDownload))
+		if i > 20 {
+			c.Check(daily.Interval >= 3*time.Hour && daily.Interval <= 30*time.Hour, gocheck.Equals, true, gocheck.Commentf("%s", daily.Interval))
+		}
+	}
+
+	// Skipped the first time, checked again at the base interval
+	skipped := &page.Page{LastDownload: start}
+	d.Reschedule(skipped)
+	c.Check(skipped.Interval, gocheck.Equals, 3*time.Hour)
+	c.Check(skipped.NextDownload, gocheck.Equals, start.Add(3*time.Hour))
+
+	// Failures back off from MinRecrawl
+	failing := &page.Page{Failures: 3}
+	d.Reschedule(failing)
+	c.Check(failing.NextDownload.Sub(time.Now()) > 3*time.Hour, gocheck.Equals, true)
+	c.Check(d.CanDownload(failing), gocheck.Equals, ErrTooSoon)
+}
+
+func (s *DomainSuite) TestTrap(c *gocheck.C) {
+	d := &Domain{URL: "http://traps.example.com/"}
+	d.Traps = TrapLimits{MaxLength: 100, MaxSegments: 5, MaxRepeats: 2, MaxParams: 3, MaxTemplate: 3}
+	tests := map[string]bool{
+		"http://traps.example.com/a/b/c":                           false,
+		"http://traps.example.com/" + strings.Repeat("x", 100):     true,
+		"http://traps.example.com/1/2/3/4/5/6":                     true,
+		"http://traps.example.com/a/b/a/c/a":                       true,
+		"http://traps.example.com/search?a=1&b=2&c=3":              false,
+		"http://traps.example.com/search?a=1&b=2&c=3&sid=bf89a31d": true,
+	}
+	for link, trap := range tests {
+		err := d.CheckTrap(link)
+		c.Check(err != nil, gocheck.Equals, trap, gocheck.Commentf("%s: %v", link, err))
+		if err != nil {
+			c.Check(err, gocheck.FitsTypeOf, &TrapError{})
+			c.Check(err.(*TrapError).URL, gocheck.Equals, link)
+		}
+	}
+
+	// An endless calendar
+	for day := 1; day <= 3; day++ {
+		c.Check(d.CheckTrap(fmt.Sprintf("http://traps.example.com/cal/2014/06/%02d", day)), gocheck.IsNil)
+	}
+	c.Check(d.CheckTrap("http://traps.example.com/cal/2014/06/01"), gocheck.IsNil)
+	c.Check(d.CheckTrap("http://traps.example.com/cal/2014/06/04"), gocheck.FitsTypeOf, &TrapError{})
+	c.Check(d.CheckTrap("http://traps.example.com/cal/2014/06/04"), gocheck.FitsTypeOf, &TrapError{})
+
+	d.Traps.MaxTemplate = -1
+	c.Check(d.CheckTrap("http://traps.example.com/cal/2014/06/05"), gocheck.IsNil)
+
+	u, _ := url.Parse("http://Traps.example.com/cal/2014/06?view=week&day=3")
+	c.Check(Template(u), gocheck.Equals, "traps.example.com/cal/0/0?day&view")
+}
+
 func (s *DomainSuite) TestDomain(c *gocheck.C) {
 	tests := map[*Domain]string{
 		&Domain{URL: "http://google.com"}:       "google.com",
 		&Domain{URL: "http://www.google.com"}:   "google.com",
-		&Domain{URL: "http://blogs.google.com"}: "blogs.google.com",
+		&Domain{URL: "http://blogs.google.com"}: "google.com",
+		&Domain{URL: "http://www.moko.com.cn"}:  "moko.com.cn",
+		&Domain{URL: "http://127.0.0.1:8084/"}:  "127.0.0.1:8084",
 	}
 	for d, exp := range tests {
 		c.Assert(d.Domain(), gocheck.Equals, exp)
 	}
 }
+
+func (s *DomainSuite) TestIDN(c *gocheck.C) {
+	d := &Domain{URL: "http://www.中国政府.cn/"}
+	c.Check(d.Domain(), gocheck.Equals, "xn--fiqs8sirgfmh.cn")
+	c.Check(d.DisplayName(), gocheck.Equals, "中国政府.cn")
+	c.Check(d.GetURL().Host, gocheck.Equals, "www.xn--fiqs8sirgfmh.cn")
+	c.Check(d.Validate(), gocheck.HasLen, 0)
+
+	name, err := FromURL("http://WWW.XN--FIQS8SIRGFMH.CN/a")
+	c.Check(err, gocheck.IsNil)
+	c.Check(name, gocheck.Equals, d.Domain())
+	c.Check(d.InScope("http://www.xn--fiqs8sirgfmh.cn/a"), gocheck.Equals, true)
+	c.Check(d.IsStartPoint(d.Canonical("http://WWW.中国政府.CN")), gocheck.Equals, true)
+
+	for _, bad := range []string{"http://[::1", "/relative", "http://xn--99999999999.cn/"} {
+		_, err := FromURL(bad)
+		c.Check(err, gocheck.NotNil, gocheck.Commentf(bad))
+		c.Check(d.InScope(bad), gocheck.Equals, false)
+	}
+	d = &Domain{URL: "http://xn--99999999999.cn/"}
+	c.Check(d.Domain(), gocheck.Equals, "")
+	c.Check(d.Validate(), gocheck.HasLen, 1)
+	d = &Domain{URL: "http://[::1"}
+	c.Check(d.GetURL().Path, gocheck.Equals, "/")
+}
+
+func (s *DomainSuite) TestCanonical(c *gocheck.C) {
+	d := &Domain{URL: "http://www.moko.cc"}
+	d.Canon.Strip = []string{"actionkey"}
+	c.Check(d.Canonical("HTTP://www.moko.cc/a?x=1&actionkey=X&actionkey=X#b"), gocheck.Equals, "http://www.moko.cc/a?x=1")
+	c.Check(d.Canonical("http://[::1"), gocheck.Equals, "http://[::1")
+}
+
+func (s *DomainSuite) TestCanonicalStartPoints(c *gocheck.C) {
+	d := &Domain{URL: "http://www.moko.cc"}
+	d.Canon.Strip = []string{"actionkey"}
+	c.Check(d.IsStartPoint("http://www.moko.cc/"), gocheck.Equals, true)
+	d.StartPoints = []string{"HTTP://WWW.moko.cc/a?actionkey=X#top", "http://www.moko.cc/b"}
+	d.CanonicalStartPoints()
+	c.Check(d.StartPoints, gocheck.DeepEquals, []string{"http://www.moko.cc/a", "http://www.moko.cc/b"})
+	c.Check(d.IsStartPoint("http://www.moko.cc/a"), gocheck.Equals, true)
+	c.Check(d.CanDownload(&page.Page{URL: "http://www.moko.cc/a", LastDownload: time.Now().Add(-time.Hour)}), gocheck.IsNil)
+}
+
+func (s *DomainSuite) TestScope(c *gocheck.C) {
+	d := &Domain{URL: "http://www.moko.cc/"}
+	d.Hosts = []string{"img.moko.cc", "cdn.example.com"}
+	tests := map[string][]bool{
+		// host, domain, hosts, external
+		"http://www.moko.cc/a":         {true, true, true, true},
+		"HTTP://WWW.Moko.cc:80/a":      {true, true, true, true},
+		"http://img.moko.cc/a.jpg":     {false, true, true, true},
+		"http://moko.cc/":              {false, true, false, true},
+		"http://cdn.example.com/x.css": {false, false, true, true},
+		"http://www.google.com/":       {false, false, false, true},
+	}
+	for link, exp := range tests {
+		for i, scope := range []string{"", ScopeDomain, ScopeHosts, ScopeExternal} {
+			d.Scope = scope
+			c.Check(d.Follows(link), gocheck.Equals, exp[i], gocheck.Commentf("%s %s", scope, link))
+		}
+	}
+	// Either way round
+	d = &Domain{URL: "http://中国.cn:80"}
+	c.Check(d.InScope("http://XN--FIQS8S.cn/a"), gocheck.Equals, true)
+	c.Check(d.InScope("http://中国.cn:8080/a"), gocheck.Equals, false)
+
+	d.Scope = ScopeExternal
+	c.Check(d.InScope(samplesite.URL+"/"), gocheck.Equals, false)
+	c.Check(d.CanDownload(&page.Page{URL: samplesite.URL + "/"}), gocheck.IsNil)
+	c.Check(d.CanDownload(&page.Page{URL: samplesite.URL + "/nospider"}), gocheck.Equals, ErrRobot)
+}
+
+func (s *DomainSuite) TestRetryDelay(c *gocheck.C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Retry-After", "5")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	d := &Domain{URL: ts.URL, Retries: 2}
+	f, err := d.Fetcher()
+	c.Assert(err, gocheck.IsNil)
+
+	// The Fetcher itself does not retry
+	p := page.New(ts.URL + "/busy")
+	err = p.DownloadWith(f)
+	c.Assert(err, gocheck.FitsTypeOf, new(page.StatusError))
+	c.Check(p.Failures, gocheck.Equals, 1)
+	delay, ok := d.RetryDelay(p, 1, err)
+	c.Check(ok, gocheck.Equals, true)
+	c.Check(delay >= 5*time.Second, gocheck.Equals, true)
+	_, ok = d.RetryDelay(p, 2, err)
+	c.Check(ok, gocheck.Equals, false)
+
+	p = page.New(ts.URL + "/missing")
+	err = p.DownloadWith(f)
+	_, ok = d.RetryDelay(p, 1, err)
+	c.Check(ok, gocheck.Equals, false)
+}
+
+func (s *DomainSuite) TestRetryNoProxy(c *gocheck.C) {
+	d := &Domain{URL: "http://www.moko.cc/"}
+	d.Proxies = []string{"http://cooldown.invalid:3128"}
+	f, err := d.Fetcher()
+	c.Assert(err, gocheck.IsNil)
+	proxy, err := d.proxies.Pick()
+	c.Assert(err, gocheck.IsNil)
+	for i := 0; i < download.ProxyMaxFails; i++ {
+		proxy.Report(0, download.ErrNoProxy)
+	}
+
+	// Requeued for when the proxy is back, not failed
+	p := page.New("http://www.moko.cc/a")
+	err = p.DownloadWith(f)
+	c.Assert(err, gocheck.Equals, download.ErrNoProxy)
+	delay, ok := d.RetryDelay(p, 1, err)
+	c.Check(ok, gocheck.Equals, true)
+	c.Check(delay > download.ProxyCooldown-time.Minute && delay <= download.ProxyCooldown, gocheck.Equals, true, gocheck.Commentf("%s", delay))
+}
@@ -0,0 +1,209 @@
+package domain
+
+import (
+	"download"
+	"errors"
+	"expvar"
+	"logger"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultMaxDelay caps the adaptive delay of domains that do not set
+// MaxDelay.
+const DefaultMaxDelay = 10 * time.Minute
+
+// How the adaptive delay moves. It doubles on errors, 429s, 5xx answers and
+// used up rate limits, grows by a quarter when responses take twice as long
+// as usual or the rate limit runs low, and otherwise comes down a tenth per
+// response.
+const (
+	latencyFast  = 0.3  // Weight of a response in the recent latency
+	latencySlow  = 0.05 // Weight of a response in the usual latency
+	minDelayStep = time.Second
+)
+
+var ErrDelayBounds = errors.New("MinDelay is over MaxDelay")
+
+// pacer holds the adaptive delay of a domain, shared by all its copies.
+type pacer struct {
+	mutex     sync.Mutex
+	delay     time.Duration
+	latency   float64 // Seconds, recent responses weighing most
+	baseline  float64 // Seconds, over a longer stretch
+	throttled int64
+	changed   bool // Since the last call to AdaptedDelay
+}
+
+// DelayStats is a snapshot of a domain's adaptive delay.
+type DelayStats struct {
+	Delay     time.Duration // Current delay between requests
+	Latency   time.Duration // Recent response time
+	Baseline  time.Duration // Usual response time
+	Throttled int64         // Responses that raised the delay
+}
+
+var (
+	pacersMu sync.Mutex
+	pacers   = make(map[string]*pacer)
+)
+
+func init() {
+	expvar.Publish("delay", expvar.Func(func() interface{} {
+		return Delays()
+	}))
+}
+
+// Delays returns the adaptive delay of every domain using one, by name.
+func Delays() (stats map[string]DelayStats) {
+	pacersMu.Lock()
+	defer pacersMu.Unlock()
+	stats = make(map[string]DelayStats, len(pacers))
+	for name, p := range pacers {
+		p.mutex.Lock()
+		stats[name] = DelayStats{
+			Delay:     p.delay,
+			Latency:   seconds(p.latency),
+			Baseline:  seconds(p.baseline),
+			Throttled: p.throttled,
+		}
+		p.mutex.Unlock()
+	}
+	return
+}
+
+// Observe adjusts the delay of a domain with AdaptiveDelay set to how the
+// server answered a request, resp being nil if it did not.
+func (d *Domain) Observe(resp *download.Response) {
+	if !d.AdaptiveDelay {
+		return
+	}
+	p := d.pacer()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	before := p.delay
+	next, why := p.next(resp)
+	p.delay = d.clampDelay(next)
+	p.changed = p.changed || p.delay != before
+	if p.delay > before {
+		p.throttled++
+		logger.Debug.Printf("Delay of %s up from %s to %s: %s", d.Domain(), before, p.delay, why)
+	}
+}
+
+// AdaptedDelay returns the adaptive delay of the domain to be saved, see
+// DelayChanged and RestoreDelay.
+func (d *Domain) AdaptedDelay() time.Duration {
+	p := d.pacer()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.changed = false
+	return p.delay
+}
+
+// DelayChanged reports whether the adaptive delay moved since the last call
+// to AdaptedDelay.
+func (d *Domain) DelayChanged() bool {
+	if !d.AdaptiveDelay {
+		return false
+	}
+	p := d.pacer()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.changed
+}
+
+// RestoreDelay picks the adaptive delay up where an earlier run left it,
+// within MinDelay and MaxDelay. A delay of 0 keeps Delay.
+func (d *Domain) RestoreDelay(delay time.Duration) {
+	if !d.AdaptiveDelay || delay <= 0 {
+		return
+	}
+	p := d.pacer()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.delay = d.clampDelay(delay)
+}
+
+// next returns the delay after resp and why it went up, if it did.
+func (p *pacer) next(resp *download.Response) (delay time.Duration, why string) {
+	up := func(d time.Duration) time.Duration {
+		if d < minDelayStep {
+			return minDelayStep
+		}
+		return d
+	}
+	switch {
+	case resp == nil:
+		return up(p.delay * 2), "no answer"
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError:
+		delay = up(p.delay * 2)
+		if after, ok := download.RetryAfter(resp.Header, time.Now()); ok && after > delay {
+			delay = after
+		}
+		return delay, "HTTP " + strconv.Itoa(resp.StatusCode)
+	}
+
+	latency := resp.Timing.Total.Seconds()
+	if p.baseline == 0 {
+		p.latency, p.baseline = latency, latency
+	} else {
+		p.latency += latencyFast * (latency - p.latency)
+		p.baseline += latencySlow * (latency - p.baseline)
+	}
+	remaining, limit := rateLimit(resp.Header)
+	switch {
+	case remaining == 0:
+		return up(p.delay * 2), "rate limit used up"
+	case limit > 0 && remaining*10 < limit:
+		return up(p.delay * 5 / 4), "rate limit running low"
+	case p.latency > 2*p.baseline:
+		return up(p.delay * 5 / 4), "responses slowing down"
+	}
+	return p.delay - p.delay/10, ""
+}
+
+// pacer returns the adaptive delay of the domain, starting out at Delay.
+func (d *Domain) pacer() *pacer {
+	pacersMu.Lock()
+	defer pacersMu.Unlock()
+	p, ok := pacers[d.Domain()]
+	if !ok {
+		p = &pacer{delay: d.clampDelay(d.Delay)}
+		pacers[d.Domain()] = p
+	}
+	return p
+}
+
+func (d *Domain) clampDelay(delay time.Duration) time.Duration {
+	max := d.MaxDelay
+	if max <= 0 {
+		max = DefaultMaxDelay
+	}
+	switch {
+	case delay < d.MinDelay:
+		return d.MinDelay
+	case delay > max:
+		return max
+	}
+	return delay
+}
+
+// rateLimit returns the X-RateLimit-Remaining and X-RateLimit-Limit headers,
+// -1 for those missing.
+func rateLimit(h http.Header) (remaining, limit int) {
+	remaining, limit = -1, -1
+	if v, err := strconv.Atoi(h.Get("X-RateLimit-Remaining")); err == nil {
+		remaining = v
+	}
+	if v, err := strconv.Atoi(h.Get("X-RateLimit-Limit")); err == nil {
+		limit = v
+	}
+	return
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
@@ -0,0 +1,82 @@
+package domain
+
+import (
+	"errors"
+	"page"
+	"time"
+)
+
+// DefaultMaxRecrawl caps the time between downloads of a page for domains
+// that do not set MaxRecrawl.
+const DefaultMaxRecrawl = 30 * 24 * time.Hour
+
+var ErrRecrawlBounds = errors.New("MinRecrawl is over MaxRecrawl")
+
+// Reschedule sets when p is due again after a download, from how often its
+// content changed so far: the time since its first download split by the
+// changes seen. A page that changed again is checked at most half as long
+// after, one that did not at least half as long again, so the interval
+// follows pages that change faster or slower than checked. It stays between
+// MinRecrawl and MaxRecrawl.
+//
+// Failed downloads are retried after MinRecrawl, doubling with every
+// failure in a row.
+func (d *Domain) Reschedule(p *page.Page) {
+	min, max := d.recrawlBounds()
+	if p.Failures > 0 {
+		backoff := max
+		if p.Failures < 32 && min<<uint(p.Failures-1) < max {
+			backoff = min << uint(p.Failures-1)
+		}
+		p.NextDownload = time.Now().Add(backoff)
+		return
+	}
+
+	interval := p.Interval
+	if interval == 0 {
+		interval = d.Redownload
+	}
+	// Download leaves LastModified at LastDownload when the content changed
+	changed := p.LastModified.Equal(p.LastDownload)
+	// Skipped or empty bodies leave no first download to go by yet
+	first := p.FirstDownload
+	if !first.IsZero() && first.UnixNano() > 0 && !first.Equal(p.LastDownload) {
+		if changed {
+			p.Changes++
+		}
+		estimate := p.LastDownload.Sub(p.FirstDownload) / time.Duration(p.Changes+1)
+		switch {
+		case changed && estimate < interval/2:
+			interval = estimate
+		case changed:
+			interval /= 2
+		case estimate > interval*3/2:
+			interval = estimate
+		default:
+			interval = interval * 3 / 2
+		}
+	}
+	switch {
+	case interval < min:
+		interval = min
+	case interval > max:
+		interval = max
+	}
+	p.Interval = interval
+	p.NextDownload = p.LastDownload.Add(interval)
+}
+
+// recrawlBounds returns MinRecrawl, Redownload if not set, and MaxRecrawl.
+func (d *Domain) recrawlBounds() (min, max time.Duration) {
+	min, max = d.MinRecrawl, d.MaxRecrawl
+	if min <= 0 {
+		min = d.Redownload
+	}
+	if max <= 0 {
+		max = DefaultMaxRecrawl
+	}
+	if max < min {
+		max = min
+	}
+	return
+}
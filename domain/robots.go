@@ -0,0 +1,186 @@
+package domain
+
+import (
+	"download"
+	"github.com/temoto/robotstxt-go"
+	"logger"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// How long robots.txt files are cached. A server error or an unreachable
+// server denies access for RobotsRetry, then the file is asked for again.
+var (
+	RobotsTTL   = 24 * time.Hour
+	RobotsRetry = 10 * time.Minute
+)
+
+// Longer robots.txt files are cut off, like Google does
+const maxRobotsSize = 500 << 10
+
+type robots struct {
+	group     *robotstxt.Group
+	sitemaps  []string
+	temporary bool // Denied until expires because of a server error
+	expires   time.Time
+}
+
+// Shared by all copies of a Domain, by scheme and host
+var (
+	robotsMu    sync.Mutex
+	robotsCache = make(map[string]*robots)
+)
+
+// UpdateRobotRules fetches the robots.txt file of the domain again, even if
+// the cached copy has not expired yet.
+func (d *Domain) UpdateRobotRules() {
+	key, ok := robotsKey(d.GetURL())
+	if !ok {
+		return
+	}
+	r := d.fetchRobots(key)
+	robotsMu.Lock()
+	robotsCache[key] = r
+	robotsMu.Unlock()
+}
+
+// CrawlDelay is the time to wait between requests to the domain: Delay, or
+// the adaptive delay with AdaptiveDelay set, or the Crawl-delay of
+// robots.txt if that is longer.
+func (d *Domain) CrawlDelay() time.Duration {
+	delay := d.Delay
+	if d.AdaptiveDelay {
+		p := d.pacer()
+		p.mutex.Lock()
+		delay = p.delay
+		p.mutex.Unlock()
+	}
+	if r := d.robots(d.GetURL()); r != nil && r.group.CrawlDelay > delay {
+		return r.group.CrawlDelay
+	}
+	return delay
+}
+
+// Sitemaps returns the sitemap URLs configured for the domain followed by
+// those listed in its robots.txt.
+func (d *Domain) Sitemaps() (sitemaps []string) {
+	sitemaps = append(sitemaps, d.Sitemap...)
+	if r := d.robots(d.GetURL()); r != nil {
+		for _, s := range r.sitemaps {
+			if !contains(sitemaps, s) {
+				sitemaps = append(sitemaps, s)
+			}
+		}
+	}
+	return
+}
+
+func contains(list []string, s string) bool {
+	for i := range list {
+		if list[i] == s {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRobots returns ErrRobot if the robots.txt of u's host disallows u, or
+// ErrRobotsDown if it could not be fetched.
+func (d *Domain) checkRobots(u *url.URL) error {
+	if r := d.robots(u); r != nil {
+		if r.temporary {
+			return ErrRobotsDown
+		}
+		// Rules may cover query strings, as in "Disallow: /search?q="
+		if !r.group.Test(u.RequestURI()) {
+			return ErrRobot
+		}
+	}
+	return nil
+}
+
+// robots returns the cached rules of u's scheme and host, fetching them with
+// the domain's session if they are missing or expired. URLs other than
+// http(s) ones have none.
+func (d *Domain) robots(u *url.URL) *robots {
+	key, ok := robotsKey(u)
+	if !ok {
+		return nil
+	}
+	robotsMu.Lock()
+	r := robotsCache[key]
+	robotsMu.Unlock()
+	if r != nil && time.Now().Before(r.expires) {
+		return r
+	}
+	// Two copies of a domain may both fetch, the later one wins
+	r = d.fetchRobots(key)
+	robotsMu.Lock()
+	robotsCache[key] = r
+	robotsMu.Unlock()
+	return r
+}
+
+func robotsKey(u *url.URL) (key string, ok bool) {
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", false
+	}
+	return u.Scheme + "://" + u.Host, true
+}
+
+// fetchRobots downloads robots.txt from key (scheme and host). Following
+// Google, a 4xx answer allows everything and a 5xx one denies everything for
+// the time being; so does a server that cannot be reached.
+func (d *Domain) fetchRobots(key string) (r *robots) {
+	r = &robots{expires: time.Now().Add(RobotsTTL)}
+	data := &robotstxt.RobotsData{}
+	defer func() {
+		r.group = data.FindGroup(download.BotName)
+		r.sitemaps = data.Sitemaps
+	}()
+
+	var resp *download.Response
+	f, err := d.FileFetcher(maxRobotsSize)
+	if err == nil {
+		resp, err = f.Fetch(download.NewRequest(key + "/robots.txt"))
+	}
+	switch {
+	case resp == nil:
+		logger.Warn.Printf("Error fetching robots.txt of %s: %s", key, err)
+		fallthrough
+	case resp.StatusCode >= http.StatusInternalServerError:
+		r.temporary, r.expires = true, time.Now().Add(RobotsRetry)
+		return
+	case !resp.OK():
+		return
+	}
+	parsed, err := robotstxt.FromBytes(resp.Bytes())
+	if err != nil {
+		logger.Warn.Printf("Error parsing robots.txt of %s: %s", key, err)
+		return
+	}
+	data = parsed
+	// Relative sitemap URLs are not allowed, but are out there
+	base, _ := url.Parse(resp.EffectiveURL)
+	for i, s := range data.Sitemaps {
+		if u, err := base.Parse(s); err == nil {
+			data.Sitemaps[i] = u.String()
+		}
+	}
+	return
+}
+
+// FileFetcher returns a Fetcher for files of the domain other than its
+// pages, such as robots.txt or sitemaps: it shares the session and profile
+// of Fetcher, but accepts any content type up to maxSize bytes.
+func (d *Domain) FileFetcher(maxSize int64) (f download.Fetcher, err error) {
+	opts, err := d.options()
+	if err != nil {
+		return
+	}
+	opts.ContentTypes = nil
+	opts.MaxBodySize = maxSize
+	return download.New("", opts)
+}
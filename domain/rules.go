@@ -0,0 +1,184 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Rule includes or excludes the URLs of a domain by one part of them. Rules
+// are tried highest Priority first, and in the order listed among equal
+// priorities; the first one that matches decides. A URL no rule matches is
+// crawled, unless there are include rules, then it is not.
+//
+// Rules apply on top of the Include and Exclude path regexps, which keep
+// working as before.
+type Rule struct {
+	Action   string // RuleInclude or RuleExclude
+	Target   string // Part of the URL matched, TargetPath if empty
+	Param    string // Query parameter matched under TargetParam
+	Match    string // How Pattern is matched, MatchRegexp if empty
+	Pattern  string
+	Priority int
+}
+
+const (
+	RuleInclude = "include"
+	RuleExclude = "exclude"
+)
+
+// Rule targets
+const (
+	TargetPath  = "path"  // Unescaped path, "/a b/"
+	TargetQuery = "query" // Raw query string without the "?"
+	TargetParam = "param" // Every value of the query parameter Param; no match if it is missing
+	TargetHost  = "host"  // Host name in lower case, without the port
+	TargetURL   = "url"   // The whole URL
+)
+
+// Rule matchers
+const (
+	MatchRegexp = "regexp" // Pattern is found anywhere, anchor it with ^ and $ if need be
+	MatchGlob   = "glob"   // Pattern matches all of it; * is any run of characters, ? any one
+	MatchPrefix = "prefix" // It starts with Pattern
+)
+
+var (
+	ErrRuleExclude = errors.New("Exclude rule matched")
+	ErrRuleInclude = errors.New("No include rule matched")
+	ErrRuleAction  = errors.New("Rule action is neither include nor exclude")
+	ErrRuleTarget  = errors.New("Unknown rule target")
+	ErrRuleMatch   = errors.New("Unknown rule matcher")
+	ErrRuleParam   = errors.New("Param rule without a parameter name")
+)
+
+type rule struct {
+	Rule
+	re *regexp.Regexp // Regexp and glob rules
+}
+
+func (r Rule) String() string {
+	target := r.Target
+	if target == TargetParam {
+		target += " " + r.Param
+	}
+	return fmt.Sprintf("%s %s %s %q", r.Action, target, r.Match, r.Pattern)
+}
+
+func (r Rule) compile() (c *rule, err error) {
+	c = &rule{Rule: r}
+	if c.Target == "" {
+		c.Target = TargetPath
+	}
+	if c.Match == "" {
+		c.Match = MatchRegexp
+	}
+	switch {
+	case c.Action != RuleInclude && c.Action != RuleExclude:
+		return nil, ErrRuleAction
+	case c.Target == TargetParam && c.Param == "":
+		return nil, ErrRuleParam
+	}
+	switch c.Target {
+	case TargetPath, TargetQuery, TargetParam, TargetHost, TargetURL:
+	default:
+		return nil, ErrRuleTarget
+	}
+	switch c.Match {
+	case MatchRegexp:
+		c.re, err = regexp.Compile(c.Pattern)
+	case MatchGlob:
+		c.re, err = regexp.Compile(glob(c.Pattern))
+	case MatchPrefix:
+	default:
+		err = ErrRuleMatch
+	}
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// glob turns a glob pattern into an anchored regexp.
+func glob(pattern string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, c := range pattern {
+		switch c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+func (r *rule) matches(rawurl string, u *url.URL) bool {
+	switch r.Target {
+	case TargetPath:
+		return r.match(u.Path)
+	case TargetQuery:
+		return r.match(u.RawQuery)
+	case TargetParam:
+		for _, v := range u.Query()[r.Param] {
+			if r.match(v) {
+				return true
+			}
+		}
+		return false
+	case TargetHost:
+		return r.match(strings.ToLower(u.Hostname()))
+	}
+	return r.match(rawurl)
+}
+
+func (r *rule) match(s string) bool {
+	if r.Match == MatchPrefix {
+		return strings.HasPrefix(s, r.Pattern)
+	}
+	return r.re.MatchString(s)
+}
+
+// buildRules compiles Rules in the order they are tried. Rules that do not
+// compile are left out.
+func (d *Domain) buildRules() (out []*rule, errs []error) {
+	out = make([]*rule, 0, len(d.Rules))
+	for i, r := range d.Rules {
+		c, err := r.compile()
+		if err != nil {
+			errs = append(errs, &ConfigError{Domain: d.URL, Field: fmt.Sprintf("Rules[%d]", i), Value: r.String(), Err: err})
+			continue
+		}
+		out = append(out, c)
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].Priority > out[j].Priority
+	})
+	return
+}
+
+// checkRules returns ErrRuleExclude or ErrRuleInclude if Rules keep rawurl
+// from being crawled.
+func (d *Domain) checkRules(rawurl string, u *url.URL) error {
+	include := false
+	for _, r := range d.rules {
+		if r.matches(rawurl, u) {
+			if r.Action == RuleExclude {
+				return ErrRuleExclude
+			}
+			return nil
+		}
+		include = include || r.Action == RuleInclude
+	}
+	if include {
+		return ErrRuleInclude
+	}
+	return nil
+}
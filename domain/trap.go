@@ -0,0 +1,146 @@
+package domain
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// TrapLimits tell URLs that look like a crawler trap, such as endless
+// calendars, relative links nesting ever deeper and session IDs, from the
+// rest. Zero values mean the DefaultTrapLimits one, negative ones no limit.
+type TrapLimits struct {
+	MaxLength   int // Characters in a URL
+	MaxSegments int // Path segments
+	MaxRepeats  int // Times one path segment may occur in a path
+	MaxParams   int // Query parameters
+	MaxTemplate int // Distinct URLs sharing a template, see Template
+}
+
+var DefaultTrapLimits = TrapLimits{
+	MaxLength:   2048,
+	MaxSegments: 16,
+	MaxRepeats:  3,
+	MaxParams:   12,
+	MaxTemplate: 5000,
+}
+
+// TrapError is returned by CheckTrap for a URL that looks like a trap.
+type TrapError struct {
+	URL    string
+	Reason string
+}
+
+func (e *TrapError) Error() string {
+	return "Crawler trap: " + e.Reason
+}
+
+// Distinct URLs seen per template, by domain and template. URLs are kept
+// as hashes.
+var (
+	templatesMu sync.Mutex
+	templates   = make(map[string]map[string]map[uint64]bool)
+)
+
+// CheckTrap returns a *TrapError if rawurl looks like a crawler trap by the
+// domain's Traps limits. URLs that pass count towards their template, so
+// call it once for every new URL about to be queued.
+func (d *Domain) CheckTrap(rawurl string) error {
+	trap := func(format string, args ...interface{}) error {
+		return &TrapError{URL: rawurl, Reason: fmt.Sprintf(format, args...)}
+	}
+	if max := limit(d.Traps.MaxLength, DefaultTrapLimits.MaxLength); max > 0 && len(rawurl) > max {
+		return trap("URL longer than %d characters", max)
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return trap("%s", err)
+	}
+
+	segments := strings.FieldsFunc(u.Path, func(r rune) bool { return r == '/' })
+	if max := limit(d.Traps.MaxSegments, DefaultTrapLimits.MaxSegments); max > 0 && len(segments) > max {
+		return trap("%d path segments, more than %d", len(segments), max)
+	}
+	if max := limit(d.Traps.MaxRepeats, DefaultTrapLimits.MaxRepeats); max > 0 {
+		seen := make(map[string]int, len(segments))
+		for _, s := range segments {
+			if seen[s]++; seen[s] > max {
+				return trap("path segment %q repeated more than %d times", s, max)
+			}
+		}
+	}
+	params := 0
+	if u.RawQuery != "" {
+		params = strings.Count(u.RawQuery, "&") + 1
+	}
+	if max := limit(d.Traps.MaxParams, DefaultTrapLimits.MaxParams); max > 0 && params > max {
+		return trap("%d query parameters, more than %d", params, max)
+	}
+
+	if max := limit(d.Traps.MaxTemplate, DefaultTrapLimits.MaxTemplate); max > 0 {
+		t := Template(u)
+		h := fnv.New64a()
+		h.Write([]byte(rawurl))
+		sum := h.Sum64()
+
+		templatesMu.Lock()
+		defer templatesMu.Unlock()
+		byTemplate, ok := templates[d.Domain()]
+		if !ok {
+			byTemplate = make(map[string]map[uint64]bool)
+			templates[d.Domain()] = byTemplate
+		}
+		urls, ok := byTemplate[t]
+		if !ok {
+			urls = make(map[uint64]bool)
+			byTemplate[t] = urls
+		}
+		if !urls[sum] {
+			if len(urls) >= max {
+				return trap("more than %d URLs like %s", max, t)
+			}
+			urls[sum] = true
+		}
+	}
+	return nil
+}
+
+// Template returns what URLs generated from one pattern have in common: the
+// host and path with runs of digits replaced by "0", and the names of the
+// query parameters, sorted. /cal/2014/06?day=3&view=week becomes
+// /cal/0/0?day&view.
+func Template(u *url.URL) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(u.Host))
+	digits := false
+	for _, r := range u.Path {
+		if '0' <= r && r <= '9' {
+			if !digits {
+				b.WriteByte('0')
+			}
+			digits = true
+			continue
+		}
+		digits = false
+		b.WriteRune(r)
+	}
+	if u.RawQuery != "" {
+		var names []string
+		for name := range u.Query() {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		b.WriteString("?" + strings.Join(names, "&"))
+	}
+	return b.String()
+}
+
+func limit(v, def int) int {
+	if v == 0 {
+		return def
+	}
+	return v
+}
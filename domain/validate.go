@@ -0,0 +1,88 @@
+package domain
+
+import (
+	"canon"
+	"download"
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+var (
+	ErrNotHTTP     = errors.New("Not an absolute http or https URL")
+	ErrOutside     = errors.New("Outside the domain")
+	ErrUnreachable = errors.New("Unreachable")
+)
+
+// ConfigError describes a problem with one setting of a domain.
+type ConfigError struct {
+	Domain string // URL of the domain
+	Field  string
+	Value  string
+	Err    error
+}
+
+func (e *ConfigError) Error() string {
+	if e.Field == "URL" {
+		return fmt.Sprintf("%s: %s", e.Domain, e.Err)
+	}
+	return fmt.Sprintf("%s: %s %q: %s", e.Domain, e.Field, e.Value, e.Err)
+}
+
+// Validate checks the settings of d without touching the network: the URL,
+// start points outside the domain, regular expressions that do not compile
+// and malformed Rules, Windows, Schedule or delay bounds. It returns every
+// problem found.
+func (d *Domain) Validate() (errs []error) {
+	if err := checkURL(d.URL); err != nil {
+		errs = append(errs, &ConfigError{Domain: d.URL, Field: "URL", Value: d.URL, Err: err})
+	} else {
+		for _, sp := range d.StartPoints {
+			if err := checkURL(sp); err != nil {
+				errs = append(errs, &ConfigError{Domain: d.URL, Field: "StartPoints", Value: sp, Err: err})
+			} else if name, _ := FromURL(sp); name != d.Domain() {
+				errs = append(errs, &ConfigError{Domain: d.URL, Field: "StartPoints", Value: sp, Err: ErrOutside})
+			}
+		}
+	}
+	_, exclude := d.buildRegexp("Exclude", d.Exclude)
+	_, include := d.buildRegexp("Include", d.Include)
+	_, rules := d.buildRules()
+	errs = append(append(append(errs, exclude...), include...), rules...)
+	if d.MaxDelay > 0 && d.MinDelay > d.MaxDelay {
+		errs = append(errs, &ConfigError{Domain: d.URL, Field: "MinDelay", Value: d.MinDelay.String(), Err: ErrDelayBounds})
+	}
+	if d.MaxRecrawl > 0 && d.MinRecrawl > d.MaxRecrawl {
+		errs = append(errs, &ConfigError{Domain: d.URL, Field: "MinRecrawl", Value: d.MinRecrawl.String(), Err: ErrRecrawlBounds})
+	}
+	return append(errs, d.validateSchedule()...)
+}
+
+// CheckReachable fetches the domain URL, returning ErrUnreachable wrapped in
+// a *ConfigError if there is no answer or an error status.
+func (d *Domain) CheckReachable() (err error) {
+	f, err := d.Fetcher()
+	if err != nil {
+		return &ConfigError{Domain: d.URL, Field: "URL", Value: d.URL, Err: err}
+	}
+	resp, err := f.Fetch(download.NewRequest(d.GetURL().String()))
+	switch {
+	case resp == nil:
+		return &ConfigError{Domain: d.URL, Field: "URL", Value: d.URL, Err: fmt.Errorf("%s: %s", ErrUnreachable, err)}
+	case resp.StatusCode >= 400:
+		return &ConfigError{Domain: d.URL, Field: "URL", Value: d.URL, Err: fmt.Errorf("%s: HTTP %d", ErrUnreachable, resp.StatusCode)}
+	}
+	return nil
+}
+
+func checkURL(rawurl string) error {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ErrNotHTTP
+	}
+	_, err = canon.Host(u.Hostname())
+	return err
+}
@@ -0,0 +1,154 @@
+package domain
+
+import (
+	"cron"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Window is a time of the week a domain may be crawled in.
+type Window struct {
+	Days  []string // Weekdays it opens on, "mon" to "sun"; every day if empty
+	Start string   // "22:00", in the domain's TimeZone
+	End   string   // "06:00"; at or before Start it closes the next day
+}
+
+var (
+	ErrWindowDay  = errors.New("Not a weekday, use mon to sun")
+	ErrWindowTime = errors.New("Not a time of day, use 15:04")
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Location returns the time zone of the domain's Windows and Schedule, UTC
+// if TimeZone is not set or unknown.
+func (d *Domain) Location() *time.Location {
+	if loc, err := time.LoadLocation(d.TimeZone); err == nil {
+		return loc
+	}
+	return time.UTC
+}
+
+// InWindow reports whether the domain may be crawled at t. Domains without
+// Windows always may.
+func (d *Domain) InWindow(t time.Time) bool {
+	return !d.NextWindow(t).After(t)
+}
+
+// NextWindow returns t if the domain may be crawled at t, otherwise when its
+// next window opens. It is the zero time if none ever does.
+func (d *Domain) NextWindow(t time.Time) (next time.Time) {
+	if len(d.Windows) == 0 {
+		return t
+	}
+	t = t.In(d.Location())
+	for _, w := range d.Windows {
+		// Windows open on the day before may still be open
+		for i := -1; i <= 7; i++ {
+			start, end, err := w.on(t, i)
+			switch {
+			case err != nil, start.IsZero():
+			case !t.Before(start) && t.Before(end):
+				return t
+			case start.After(t) && (next.IsZero() || start.Before(next)):
+				next = start
+			}
+		}
+	}
+	return
+}
+
+// NextPass returns the first time after t a pass over the domain begins by
+// its Schedule, or the zero time if it has none.
+func (d *Domain) NextPass(t time.Time) time.Time {
+	if d.Schedule == "" {
+		return time.Time{}
+	}
+	s, err := cron.Parse(d.Schedule)
+	if err != nil {
+		return time.Time{}
+	}
+	return s.Next(t.In(d.Location()))
+}
+
+// on returns when w opens and closes on the day days after t's, or zero
+// times if it does not open that day.
+func (w Window) on(t time.Time, days int) (start, end time.Time, err error) {
+	day := time.Date(t.Year(), t.Month(), t.Day()+days, 0, 0, 0, 0, t.Location())
+	open, err := w.opens(day.Weekday())
+	if err != nil || !open {
+		return
+	}
+	from, err := clock(w.Start)
+	if err != nil {
+		return
+	}
+	to, err := clock(w.End)
+	if err != nil {
+		return
+	}
+	if to <= from {
+		to += 24 * 60
+	}
+	start = time.Date(day.Year(), day.Month(), day.Day(), 0, from, 0, 0, day.Location())
+	end = time.Date(day.Year(), day.Month(), day.Day(), 0, to, 0, 0, day.Location())
+	return
+}
+
+func (w Window) opens(wd time.Weekday) (open bool, err error) {
+	if len(w.Days) == 0 {
+		return true, nil
+	}
+	for _, day := range w.Days {
+		v, ok := weekdays[strings.ToLower(day)]
+		if !ok {
+			return false, ErrWindowDay
+		}
+		open = open || v == wd
+	}
+	return
+}
+
+// clock returns the minutes since midnight of "15:04". "24:00" is allowed
+// as an End.
+func clock(s string) (minutes int, err error) {
+	var h, m int
+	if n, _ := fmt.Sscanf(s, "%d:%d", &h, &m); n != 2 || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, ErrWindowTime
+	}
+	return h*60 + m, nil
+}
+
+// validateSchedule checks Windows, Schedule and TimeZone.
+func (d *Domain) validateSchedule() (errs []error) {
+	if _, err := time.LoadLocation(d.TimeZone); err != nil {
+		errs = append(errs, &ConfigError{Domain: d.URL, Field: "TimeZone", Value: d.TimeZone, Err: err})
+	}
+	for i, w := range d.Windows {
+		field := fmt.Sprintf("Windows[%d]", i)
+		if _, err := w.opens(time.Sunday); err != nil {
+			errs = append(errs, &ConfigError{Domain: d.URL, Field: field, Value: strings.Join(w.Days, ","), Err: err})
+		}
+		for _, s := range []string{w.Start, w.End} {
+			if _, err := clock(s); err != nil {
+				errs = append(errs, &ConfigError{Domain: d.URL, Field: field, Value: s, Err: err})
+			}
+		}
+	}
+	if d.Schedule != "" {
+		if _, err := cron.Parse(d.Schedule); err != nil {
+			errs = append(errs, &ConfigError{Domain: d.URL, Field: "Schedule", Value: d.Schedule, Err: err})
+		}
+	}
+	return
+}
@@ -0,0 +1,207 @@
+//go:build curl
+// +build curl
+
+package download
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"time"
+
+	curl "github.com/zengnotes/go-curl"
+)
+
+// CurlFetcher downloads through libcurl. It is only built with -tags curl
+// since it needs the libcurl headers at build time. Options.Preflight is
+// ignored, a body over MaxBodySize aborts the transfer instead.
+type CurlFetcher struct {
+	opts Options
+}
+
+var _ Fetcher = new(CurlFetcher)
+
+func init() {
+	Register("curl", func(opts Options) (Fetcher, error) {
+		return NewCurl(opts), nil
+	})
+}
+
+func NewCurl(opts Options) *CurlFetcher {
+	if opts.Jar == nil {
+		opts.Jar = NewJar()
+	}
+	return &CurlFetcher{opts: opts}
+}
+
+func (f *CurlFetcher) Fetch(req *Request) (resp *Response, err error) {
+	easy := curl.EasyInit()
+	defer easy.Cleanup()
+
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		return
+	}
+
+	h := make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		h[k] = v
+	}
+	f.opts.setHeader(h)
+	headers := make([]string, 0, len(h)+1)
+	for k, v := range h {
+		for i := range v {
+			headers = append(headers, k+": "+v[i])
+		}
+	}
+	// Cookies come from our own jar rather than curl's cookie engine so they
+	// can be kept per domain
+	if cookies := f.opts.Jar.Cookies(u); len(cookies) > 0 {
+		pairs := make([]string, len(cookies))
+		for i, c := range cookies {
+			pairs[i] = c.Name + "=" + c.Value
+		}
+		headers = append(headers, "Cookie: "+strings.Join(pairs, "; "))
+	}
+
+	var body, header bytes.Buffer
+	var setCookies []string
+	var tooLarge bool
+	easy.Setopt(curl.OPT_URL, req.URL)
+	if len(req.Body) > 0 {
+		easy.Setopt(curl.OPT_POSTFIELDS, string(req.Body))
+	}
+	if m := req.method(); m != "GET" && (m != "POST" || len(req.Body) == 0) {
+		easy.Setopt(curl.OPT_CUSTOMREQUEST, m)
+	}
+	easy.Setopt(curl.OPT_TIMEOUT, int(f.opts.timeout()/time.Second))
+	easy.Setopt(curl.OPT_CONNECTTIMEOUT, int(f.opts.connectTimeout()/time.Second))
+	easy.Setopt(curl.OPT_HTTPHEADER, headers)
+	easy.Setopt(curl.OPT_FOLLOWLOCATION, true)
+	easy.Setopt(curl.OPT_MAXREDIRS, f.opts.maxRedirects())
+	if tls := f.opts.TLS; tls.InsecureSkipVerify {
+		easy.Setopt(curl.OPT_SSL_VERIFYPEER, false)
+		easy.Setopt(curl.OPT_SSL_VERIFYHOST, 0)
+	} else if tls.CAFile != "" {
+		// Replaces rather than extends curl's own bundle
+		easy.Setopt(curl.OPT_CAINFO, tls.CAFile)
+	}
+	if f.opts.TLS.CertFile != "" {
+		easy.Setopt(curl.OPT_SSLCERT, f.opts.TLS.CertFile)
+		easy.Setopt(curl.OPT_SSLKEY, f.opts.TLS.KeyFile)
+	}
+	easy.Setopt(curl.OPT_WRITEFUNCTION, func(buf []byte, userdata interface{}) bool {
+		f.opts.wait(len(buf))
+		// Returning false aborts the transfer
+		if max := f.opts.MaxBodySize; max > 0 && int64(body.Len()+len(buf)) > max {
+			body.Write(buf[:max-int64(body.Len())])
+			tooLarge = true
+			return false
+		}
+		body.Write(buf)
+		return true
+	})
+	easy.Setopt(curl.OPT_HEADERFUNCTION, func(buf []byte, userdata interface{}) bool {
+		// A new status line means curl followed a redirect; only keep the
+		// headers of the last response
+		if bytes.HasPrefix(buf, []byte("HTTP/")) {
+			header.Reset()
+		}
+		header.Write(buf)
+		if line := string(buf); len(line) > 11 && strings.EqualFold(line[:11], "Set-Cookie:") {
+			setCookies = append(setCookies, strings.TrimSpace(line[11:]))
+		}
+		return true
+	})
+	var proxy *Proxy
+	if f.opts.Proxies != nil {
+		if proxy, err = f.opts.Proxies.Pick(); err != nil {
+			return
+		}
+		// curl speaks both CONNECT and socks5:// itself
+		easy.Setopt(curl.OPT_PROXY, proxy.URL.String())
+	}
+	start := time.Now()
+	err = easy.Perform()
+	if proxy != nil {
+		proxy.Report(time.Since(start), err)
+	}
+	if err != nil && !tooLarge {
+		return
+	}
+	err = nil
+
+	resp = &Response{
+		URL:    req.URL,
+		Header: parseHeader(header.Bytes()),
+	}
+	resp.SetBody(body.Bytes())
+	Stats.Add("requests", 1)
+	Stats.Add("bytes", resp.Size)
+
+	if v, err := easy.Getinfo(curl.INFO_RESPONSE_CODE); err == nil {
+		resp.StatusCode, _ = v.(int)
+	}
+	if v, err := easy.Getinfo(curl.INFO_EFFECTIVE_URL); err == nil {
+		resp.EffectiveURL, _ = v.(string)
+	}
+	if resp.EffectiveURL == "" {
+		resp.EffectiveURL = req.URL
+	}
+	if len(setCookies) > 0 {
+		// Cookies set along a redirect chain are attributed to the final
+		// URL, curl does not tell us which hop sent them
+		if eu, err := url.Parse(resp.EffectiveURL); err == nil {
+			cookies := (&http.Response{Header: http.Header{"Set-Cookie": setCookies}}).Cookies()
+			f.opts.Jar.SetCookies(eu, cookies)
+		}
+	}
+	if v, err := easy.Getinfo(curl.INFO_CONTENT_TYPE); err == nil {
+		resp.ContentType, _ = v.(string)
+	}
+	if resp.ContentType == "" {
+		resp.ContentType = resp.Header.Get("Content-Type")
+	}
+	if resp.ContentType == "" && resp.Size > 0 {
+		resp.ContentType = http.DetectContentType(resp.Bytes())
+	}
+	switch {
+	case tooLarge:
+		err = ErrTooLarge
+	case resp.OK() && !f.opts.allowType(resp.ContentType):
+		resp.SetBody(nil)
+		err = ErrContentType
+	}
+	countSkipped(err)
+	for info, d := range map[curl.CurlInfo]*time.Duration{
+		curl.INFO_NAMELOOKUP_TIME:    &resp.Timing.NameLookup,
+		curl.INFO_CONNECT_TIME:       &resp.Timing.Connect,
+		curl.INFO_PRETRANSFER_TIME:   &resp.Timing.PreTransfer,
+		curl.INFO_STARTTRANSFER_TIME: &resp.Timing.StartTransfer,
+		curl.INFO_TOTAL_TIME:         &resp.Timing.Total,
+	} {
+		if v, err := easy.Getinfo(info); err == nil {
+			if secs, ok := v.(float64); ok {
+				*d = time.Duration(secs * float64(time.Second))
+			}
+		}
+	}
+	return
+}
+
+// parseHeader turns the raw header block collected from curl into an
+// http.Header, skipping the status line.
+func parseHeader(raw []byte) http.Header {
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(raw)))
+	if line, err := r.ReadLine(); err != nil || !strings.HasPrefix(line, "HTTP/") {
+		return http.Header{}
+	}
+	h, err := r.ReadMIMEHeader()
+	if err != nil && len(h) == 0 {
+		return http.Header{}
+	}
+	return http.Header(h)
+}
@@ -1,56 +1,198 @@
 package download
 
 import (
-	//"net/http"
-	//"net/http/cookiejar"
 	"bytes"
-	curl "github.com/zengnotes/go-curl"
-	"logger"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
 )
 
 const (
 	//BotName   = ""
 	//BotURL    = "http://www.baidu.com"
 	UserAgent = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_9_3) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/34.0.1847.137 Safari/537.36" //BotName + " (+" + BotURL + ")"
+
+	DefaultTimeout        = 30 * time.Second
+	DefaultConnectTimeout = 10 * time.Second
+	DefaultMaxRedirects   = 10
+)
+
+// BotName is the user agent robots.txt rules are looked up for.
+var BotName = "GoSpiderBot"
+
+// Fetcher performs a single download. Implementations must be safe for
+// concurrent use. A response breaking the MaxBodySize or ContentTypes limits
+// is returned together with ErrTooLarge or ErrContentType; its Body holds
+// whatever was read before the limit hit.
+type Fetcher interface {
+	Fetch(req *Request) (resp *Response, err error)
+}
+
+// Options configure a Fetcher. Zero values fall back to the package defaults.
+type Options struct {
+	Profile
+	Jar          http.CookieJar // Cookie storage, defaults to a fresh Jar
+	Proxies      *ProxyPool     // Proxies to go through, nil connects directly
+	MaxBodySize  int64          // Longest body to read, 0 for no limit
+	ContentTypes []string       // Media types a 2xx body may have, empty allows any
+	Preflight    bool           // Check the limits with a HEAD request first
+	Bandwidth    *Limiter       // Throttles bodies on top of Global, nil for no own limit
+}
+
+// Request describes what to fetch.
+type Request struct {
+	Method string // Defaults to GET
+	URL    string
+	Header http.Header // Extra request headers
+	Body   []byte      // Sent with POST and the like
+	Secret bool        // Carries credentials, never recorded, see Recorder
+}
+
+// Response describes the outcome of a single fetch. Body is always fully
+// buffered, so it may be read after the transfer has finished.
+type Response struct {
+	URL          string        // URL originally requested
+	EffectiveURL string        // URL after following redirects
+	StatusCode   int           // HTTP status code of the final response
+	Header       http.Header   // Headers of the final response
+	ContentType  string        // Value of the Content-Type header
+	Size         int64         // Body bytes transferred
+	Timing       Timing        // Where the time went
+	Body         io.ReadCloser // Response body
+	data         []byte
+
+	// What went over the wire, for archiving. Fetchers fill in what they can.
+	Proto         string      // Protocol of the final response, e.g. HTTP/1.1
+	RequestHeader http.Header // Headers sent with the final request, cookies included
+	RemoteAddr    string      // Address of the server (or proxy) that answered
+	Date          time.Time   // When the request was sent
+	Redirects     []*Response // Redirect answers that led to this one, in order
+}
+
+// Timing breaks a fetch down into its phases. Each value is measured from the
+// start of the request.
+type Timing struct {
+	NameLookup    time.Duration // DNS resolution finished
+	Connect       time.Duration // TCP connection established
+	PreTransfer   time.Duration // Request about to be sent (TLS done)
+	StartTransfer time.Duration // First response byte received
+	Total         time.Duration // Transfer finished
+}
+
+var (
+	ErrUnknownFetcher   = errors.New("Unknown fetcher")
+	ErrTooManyRedirects = errors.New("Too many redirects")
 )
 
-/*
-//var client = new(http.Client)
+// DefaultFetcher is used by Get. SetDefault replaces it.
+var DefaultFetcher Fetcher
+
+var (
+	fetchersMu  sync.RWMutex
+	fetchers    = make(map[string]func(Options) (Fetcher, error))
+	defaultName = "http"
+)
 
 func init() {
-	// Turns out cookiejar.New() returns a nil error
-	//client.Jar, _ = cookiejar.New(nil)
-}
-
-func Do(req *http.Request) (resp *http.Response, err error) {
-	req.Header.Add("User-Agent", UserAgent)
-	return client.Do(req)
-}
-*/
-func Get(url string) (bodybuf []byte, err error) {
-	/*
-		req, err := http.NewRequest("GET", url, nil)
-		if err != nil {
-			return
-		}
-		return Do(req)
-	*/
-	easy := curl.EasyInit()
-	defer easy.Cleanup()
-	//bodybuf = []byte{}
-	easy.Setopt(curl.OPT_URL, url)
-	easy.Setopt(curl.OPT_TIMEOUT, 5)
-	fooTest := func(buf []byte, userdata interface{}) bool {
-		var tempbuf bytes.Buffer
-		tempbuf.Write(bodybuf)
-		tempbuf.Write(buf)
-		bodybuf = tempbuf.Bytes()
-		return true
+	Register("http", func(opts Options) (Fetcher, error) {
+		return NewHTTP(opts)
+	})
+	// Default options cannot fail
+	DefaultFetcher, _ = NewHTTP(Options{})
+}
+
+// Register makes a Fetcher implementation available to New under name.
+// Implementations that need cgo or other optional dependencies register
+// themselves from behind a build tag.
+func Register(name string, fn func(Options) (Fetcher, error)) {
+	fetchersMu.Lock()
+	defer fetchersMu.Unlock()
+	fetchers[name] = fn
+}
+
+// New creates a Fetcher of the named implementation. An empty name selects
+// the implementation last passed to SetDefault ("http" unless changed).
+func New(name string, opts Options) (f Fetcher, err error) {
+	fetchersMu.RLock()
+	if name == "" {
+		name = defaultName
+	}
+	fn, ok := fetchers[name]
+	fetchersMu.RUnlock()
+	if !ok {
+		return nil, ErrUnknownFetcher
 	}
-	easy.Setopt(curl.OPT_COOKIEJAR, "./cookie.jar")
-	easy.Setopt(curl.OPT_WRITEFUNCTION, fooTest)
-	if err := easy.Perform(); err != nil {
-		logger.Error.Printf("%s Download error: %s", url, err)
+	if f, err = fn(opts); err != nil {
+		return
 	}
+	if r := getRecorder(); r != nil {
+		f = &recordFetcher{fetcher: f, recorder: r}
+	}
+	return
+}
+
+// SetDefault switches DefaultFetcher, and the implementation New picks for
+// an empty name, to the named implementation.
+func SetDefault(name string) (err error) {
+	f, err := New(name, Options{})
+	if err != nil {
+		return
+	}
+	fetchersMu.Lock()
+	defaultName = name
+	fetchersMu.Unlock()
+	DefaultFetcher = f
+	return
+}
+
+func NewRequest(url string) *Request {
+	return &Request{
+		URL:    url,
+		Header: make(http.Header),
+	}
+}
+
+// NewFormRequest returns a POST of form to rawurl.
+func NewFormRequest(rawurl string, form url.Values) (req *Request) {
+	req = NewRequest(rawurl)
+	req.Method = "POST"
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Body = []byte(form.Encode())
 	return
 }
+
+func (r *Request) method() string {
+	if r.Method == "" {
+		return "GET"
+	}
+	return r.Method
+}
+
+// Get fetches url with DefaultFetcher. Transport failures (DNS, connect,
+// timeout) are returned as err; any response the server sent, including 4xx
+// and 5xx, is returned in resp for the caller to judge.
+func Get(url string) (resp *Response, err error) {
+	return DefaultFetcher.Fetch(NewRequest(url))
+}
+
+// Bytes returns the buffered response body.
+func (r *Response) Bytes() []byte {
+	return r.data
+}
+
+// OK reports whether the final response has a 2xx status code.
+func (r *Response) OK() bool {
+	return r.StatusCode >= 200 && r.StatusCode < 300
+}
+
+// SetBody replaces the buffered body with data, for Fetchers living outside
+// this package.
+func (r *Response) SetBody(data []byte) {
+	r.data = data
+	r.Size = int64(len(data))
+	r.Body = ioutil.NopCloser(bytes.NewReader(data))
+}
@@ -2,10 +2,22 @@ package download
 
 import (
 	"bytes"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 )
 
 var ts *httptest.Server
@@ -45,7 +57,7 @@ func TestUserAgent(t *testing.T) {
 	}
 	defer resp.Body.Close()
 
-	var body, n = make([]byte, 64), 0
+	var body, n = make([]byte, len(UserAgent)+1), 0
 	if n, err = resp.Body.Read(body); err != nil {
 		t.Errorf("Error reading body: %s", err)
 	}
@@ -54,3 +66,542 @@ func TestUserAgent(t *testing.T) {
 		t.Errorf("Invalid body: '%s'", body)
 	}
 }
+
+func TestStatusAndRedirect(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/old", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/new", http.StatusMovedPermanently)
+	})
+	mux.HandleFunc("/new", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, "<html></html>")
+	})
+	mux.HandleFunc("/missing", http.NotFound)
+	s := httptest.NewServer(mux)
+	defer s.Close()
+
+	resp, err := Get(s.URL + "/old")
+	if err != nil {
+		t.Fatalf("Error calling Get: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected 200, got %d", resp.StatusCode)
+	}
+	if resp.EffectiveURL != s.URL+"/new" {
+		t.Errorf("Invalid effective URL: %s", resp.EffectiveURL)
+	}
+	if resp.ContentType != "text/html; charset=utf-8" {
+		t.Errorf("Invalid content type: %s", resp.ContentType)
+	}
+	if resp.Size != int64(len("<html></html>")) {
+		t.Errorf("Invalid size: %d", resp.Size)
+	}
+
+	resp, err = Get(s.URL + "/missing")
+	if err != nil {
+		t.Fatalf("Error calling Get: %s", err)
+	}
+	if resp.StatusCode != http.StatusNotFound || resp.OK() {
+		t.Errorf("Expected 404, got %d", resp.StatusCode)
+	}
+}
+
+func TestTransportError(t *testing.T) {
+	s := httptest.NewServer(http.NotFoundHandler())
+	url := s.URL
+	s.Close()
+
+	if _, err := Get(url); err == nil {
+		t.Error("Expected an error fetching from a closed server")
+	}
+}
+
+func TestCookies(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c, err := r.Cookie("session"); err == nil {
+			fmt.Fprint(w, c.Value)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc"})
+	}))
+	defer s.Close()
+
+	f, _ := NewHTTP(Options{})
+	for i, exp := range []string{"", "abc"} {
+		resp, err := f.Fetch(NewRequest(s.URL))
+		if err != nil {
+			t.Fatalf("Error fetching: %s", err)
+		}
+		if string(resp.Bytes()) != exp {
+			t.Errorf("Request %d: expected '%s', got '%s'", i, exp, resp.Bytes())
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New("http", Options{}); err != nil {
+		t.Errorf("Error creating http fetcher: %s", err)
+	}
+	if _, err := New("gopher", Options{}); err != ErrUnknownFetcher {
+		t.Errorf("Expected ErrUnknownFetcher, got %v", err)
+	}
+}
+
+func TestJarRoundTrip(t *testing.T) {
+	u, _ := url.Parse("http://www.example.com/a/page.html")
+	j := NewJar()
+	j.SetCookies(u, []*http.Cookie{
+		{Name: "host", Value: "1"},
+		{Name: "domain", Value: "2", Domain: "example.com", Path: "/"},
+		{Name: "gone", Value: "3", MaxAge: -1},
+	})
+	if !j.Dirty() {
+		t.Error("Jar should be dirty after SetCookies")
+	}
+
+	all := j.All()
+	if len(all) != 2 {
+		t.Fatalf("Expected 2 cookies, got %d", len(all))
+	}
+	if j.Dirty() {
+		t.Error("Jar should be clean after All")
+	}
+
+	restored := NewJar()
+	restored.Load(all)
+	if restored.Dirty() {
+		t.Error("Jar should be clean after Load")
+	}
+	for rawurl, exp := range map[string]int{
+		"http://www.example.com/a/other": 2,
+		"http://img.example.com/":        1,
+		"http://www.example.org/":        0,
+	} {
+		u, _ := url.Parse(rawurl)
+		if got := len(restored.Cookies(u)); got != exp {
+			t.Errorf("%s: expected %d cookies, got %d", rawurl, exp, got)
+		}
+	}
+}
+
+func TestReadNetscapeCookies(t *testing.T) {
+	file := "# Netscape HTTP Cookie File\n" +
+		".moko.cc\tTRUE\t/\tFALSE\t0\tsession\tabc\n" +
+		"#HttpOnly_www.moko.cc\tFALSE\t/\tTRUE\t2000000000\ttoken\txyz\n"
+	cookies, err := ReadNetscapeCookies(strings.NewReader(file))
+	if err != nil {
+		t.Fatalf("Error reading cookies: %s", err)
+	}
+	if len(cookies) != 2 {
+		t.Fatalf("Expected 2 cookies, got %d", len(cookies))
+	}
+	if c := cookies[0]; c.Domain != ".moko.cc" || c.Name != "session" || !c.Expires.IsZero() {
+		t.Errorf("Invalid session cookie: %+v", c)
+	}
+	if c := cookies[1]; c.Domain != "www.moko.cc" || !c.HttpOnly || !c.Secure || c.Expires.Unix() != 2000000000 {
+		t.Errorf("Invalid token cookie: %+v", c)
+	}
+
+	if _, err := ReadNetscapeCookies(strings.NewReader("bogus line\n")); err != ErrCookieFormat {
+		t.Errorf("Expected ErrCookieFormat, got %v", err)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2014, 6, 1, 12, 0, 0, 0, time.UTC)
+	for v, exp := range map[string]time.Duration{
+		"120":                           2 * time.Minute,
+		"-3":                            0,
+		"Sun, 01 Jun 2014 12:00:30 GMT": 30 * time.Second,
+		"Sun, 01 Jun 2014 11:00:00 GMT": 0,
+	} {
+		d, ok := RetryAfter(http.Header{"Retry-After": {v}}, now)
+		if !ok || d != exp {
+			t.Errorf("%s: expected %s, got %s (%v)", v, exp, d, ok)
+		}
+	}
+	if _, ok := RetryAfter(http.Header{"Retry-After": {"soon"}}, now); ok {
+		t.Error("Expected an invalid Retry-After to be ignored")
+	}
+
+	p := RetryPolicy{BaseDelay: time.Second, MaxDelay: time.Minute}
+	if _, ok := p.Delay(1, &Response{Header: http.Header{"Retry-After": {"3600"}}}); ok {
+		t.Error("Expected to give up on a Retry-After longer than MaxDelay")
+	}
+	if d, _ := p.Delay(3, &Response{}); d != 4*time.Second {
+		t.Errorf("Expected a 4s backoff for the third attempt, got %s", d)
+	}
+}
+
+func TestTemporary(t *testing.T) {
+	for code, exp := range map[int]bool{
+		http.StatusOK:                  false,
+		http.StatusNotFound:            false,
+		http.StatusRequestTimeout:      true,
+		http.StatusTooManyRequests:     true,
+		http.StatusInternalServerError: true,
+		http.StatusNotImplemented:      false,
+		http.StatusServiceUnavailable:  true,
+	} {
+		if got := Temporary(&Response{StatusCode: code}, nil); got != exp {
+			t.Errorf("HTTP %d: expected %v, got %v", code, exp, got)
+		}
+	}
+	for err, exp := range map[error]bool{
+		&net.DNSError{Err: "no such host", Name: "nx.invalid", IsNotFound: true}: false,
+		&net.DNSError{Err: "timeout", Name: "slow.example", IsTimeout: true}:     true,
+		&url.Error{Op: "Get", URL: "http://x/", Err: syscall.ECONNRESET}:         true,
+		&url.Error{Op: "Get", URL: "http://x/", Err: io.EOF}:                     true,
+		&url.Error{Op: "Get", URL: "http://x/", Err: ErrTooManyRedirects}:        false,
+		ErrNoProxy: true,
+	} {
+		if got := Temporary(nil, err); got != exp {
+			t.Errorf("%s: expected %v, got %v", err, exp, got)
+		}
+	}
+}
+
+// proxyServer is a stand-in forward proxy answering every request itself
+// with its name and the URL it was asked for.
+func proxyServer(name string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", name, r.URL)
+	}))
+}
+
+func TestProxyPool(t *testing.T) {
+	a, b := proxyServer("a"), proxyServer("b")
+	defer b.Close()
+
+	pool, err := NewProxyPool([]string{a.URL, b.URL}, false)
+	if err != nil {
+		t.Fatalf("Error creating pool: %s", err)
+	}
+	f, _ := NewHTTP(Options{Proxies: pool})
+	for i, exp := range []string{"a", "b", "a"} {
+		resp, err := f.Fetch(NewRequest("http://example.com/page"))
+		if err != nil {
+			t.Fatalf("Error fetching: %s", err)
+		}
+		if string(resp.Bytes()) != exp+" http://example.com/page" {
+			t.Errorf("Request %d: expected proxy %s, got '%s'", i, exp, resp.Bytes())
+		}
+	}
+
+	// A dead proxy is taken out of rotation
+	a.Close()
+	for i := 0; i < 2*ProxyMaxFails; i++ {
+		f.Fetch(NewRequest("http://example.com/page"))
+	}
+	stats := pool.Stats()
+	if !stats[0].Down || stats[0].Failures != int64(ProxyMaxFails) || stats[1].Down {
+		t.Errorf("Expected only a to be down: %+v", stats)
+	}
+	if stats[1].Requests != 1+int64(ProxyMaxFails) || stats[1].Latency <= 0 {
+		t.Errorf("Invalid stats for b: %+v", stats[1])
+	}
+
+	// and back after the cooldown
+	pool.proxies[0].downUntil = time.Now()
+	if p1, _ := pool.Pick(); p1 == nil {
+		t.Error("Expected a proxy")
+	} else if p2, _ := pool.Pick(); p1 == p2 {
+		t.Error("Expected a back in rotation")
+	}
+	b.Close()
+	pool.proxies[1].downUntil = time.Now().Add(time.Hour)
+	pool.proxies[0].downUntil = time.Now().Add(time.Hour)
+	if _, err := f.Fetch(NewRequest("http://example.com/page")); err != ErrNoProxy {
+		t.Errorf("Expected ErrNoProxy, got %v", err)
+	}
+
+	if _, err := NewProxyPool([]string{"ftp://example.com"}, false); err != ErrProxyScheme {
+		t.Errorf("Expected ErrProxyScheme, got %v", err)
+	}
+}
+
+func TestProxySticky(t *testing.T) {
+	a, b := proxyServer("a"), proxyServer("b")
+	defer a.Close()
+	defer b.Close()
+
+	pool, err := NewProxyPool([]string{a.URL, b.URL}, true)
+	if err != nil {
+		t.Fatalf("Error creating pool: %s", err)
+	}
+	f, _ := NewHTTP(Options{Proxies: pool})
+	for i := 0; i < 3; i++ {
+		resp, err := f.Fetch(NewRequest("http://example.com/"))
+		if err != nil {
+			t.Fatalf("Error fetching: %s", err)
+		}
+		if !bytes.HasPrefix(resp.Bytes(), []byte("a ")) {
+			t.Errorf("Request %d: expected proxy a, got '%s'", i, resp.Bytes())
+		}
+	}
+}
+
+func TestSOCKS5Proxy(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go socks5Server(l)
+
+	pool, err := NewProxyPool([]string{"socks5://" + l.Addr().String()}, false)
+	if err != nil {
+		t.Fatalf("Error creating pool: %s", err)
+	}
+	f, _ := NewHTTP(Options{Proxies: pool})
+	resp, err := f.Fetch(NewRequest(ts.URL + "/test"))
+	if err != nil {
+		t.Fatalf("Error fetching through SOCKS5: %s", err)
+	}
+	if string(resp.Bytes()) != "test" {
+		t.Errorf("Invalid body: '%s'", resp.Bytes())
+	}
+}
+
+// socks5Server is a bare SOCKS5 server: no authentication, CONNECT to IPv4
+// addresses only.
+func socks5Server(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			buf := make([]byte, 256)
+			// Greeting: version, method count, methods
+			if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+				return
+			}
+			if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+				return
+			}
+			conn.Write([]byte{5, 0})
+			// Request: version, CONNECT, reserved, IPv4, address, port
+			if _, err := io.ReadFull(conn, buf[:10]); err != nil || buf[3] != 1 {
+				return
+			}
+			port := strconv.Itoa(int(buf[8])<<8 | int(buf[9]))
+			target, err := net.Dial("tcp", net.JoinHostPort(net.IP(buf[4:8]).String(), port))
+			if err != nil {
+				conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+				return
+			}
+			defer target.Close()
+			conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+			go io.Copy(target, conn)
+			io.Copy(conn, target)
+		}()
+	}
+}
+
+func TestLimits(t *testing.T) {
+	var gets int
+	mux := http.NewServeMux()
+	mux.HandleFunc("/declared", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, strings.Repeat("x", 100))
+	})
+	mux.HandleFunc("/chunked", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		for i := 0; i < 10; i++ {
+			fmt.Fprint(w, strings.Repeat("x", 10))
+			w.(http.Flusher).Flush()
+		}
+	})
+	mux.HandleFunc("/zip", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			gets++
+		}
+		w.Header().Set("Content-Type", "application/zip")
+		fmt.Fprint(w, "PK")
+	})
+	mux.HandleFunc("/sniff", func(w http.ResponseWriter, r *http.Request) {
+		// Keep net/http from sniffing for us
+		w.Header()["Content-Type"] = nil
+		w.Write([]byte("\x89PNG\x0d\x0a\x1a\x0a"))
+	})
+	mux.HandleFunc("/page", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, "<html></html>")
+	})
+	s := httptest.NewServer(mux)
+	defer s.Close()
+
+	f, _ := NewHTTP(Options{MaxBodySize: 50, ContentTypes: []string{"text/*"}})
+	for path, exp := range map[string]struct {
+		err  error
+		size int64
+	}{
+		"/declared": {ErrTooLarge, 0},
+		"/chunked":  {ErrTooLarge, 50},
+		"/zip":      {ErrContentType, 0},
+		"/sniff":    {ErrContentType, 0},
+		"/page":     {nil, 13},
+	} {
+		resp, err := f.Fetch(NewRequest(s.URL + path))
+		if err != exp.err {
+			t.Errorf("%s: expected %v, got %v", path, exp.err, err)
+		}
+		if resp == nil {
+			continue
+		}
+		if resp.Size != exp.size || int64(len(resp.Bytes())) != exp.size {
+			t.Errorf("%s: expected %d bytes, got %d", path, exp.size, resp.Size)
+		}
+	}
+
+	gets = 0
+	f, _ = NewHTTP(Options{ContentTypes: []string{"text/html"}, Preflight: true})
+	if _, err := f.Fetch(NewRequest(s.URL + "/zip")); err != ErrContentType {
+		t.Errorf("Expected ErrContentType, got %v", err)
+	}
+	if gets != 0 {
+		t.Errorf("Preflight should have saved the GET, got %d", gets)
+	}
+}
+
+func TestProfile(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/loop" {
+			http.Redirect(w, r, "/loop", http.StatusFound)
+			return
+		}
+		fmt.Fprintf(w, "%s|%s|%s", r.Header.Get("User-Agent"), r.Header.Get("Accept-Language"), r.Header.Get("Referer"))
+	}))
+	defer s.Close()
+
+	f, err := New("http", Options{Profile: Profile{
+		Header: http.Header{
+			"accept-language": {"zh-CN"},
+			"Referer":         {"http://www.moko.cc/"},
+		},
+		UserAgents:   []string{"bot/1"},
+		MaxRedirects: 2,
+	}})
+	if err != nil {
+		t.Fatalf("Error creating fetcher: %s", err)
+	}
+	req := NewRequest(s.URL)
+	req.Header.Set("Referer", "http://example.com/")
+	resp, err := f.Fetch(req)
+	if err != nil {
+		t.Fatalf("Error fetching: %s", err)
+	}
+	if exp := "bot/1|zh-CN|http://example.com/"; string(resp.Bytes()) != exp {
+		t.Errorf("Expected '%s', got '%s'", exp, resp.Bytes())
+	}
+
+	if _, err = f.Fetch(NewRequest(s.URL + "/loop")); !errors.Is(err, ErrTooManyRedirects) {
+		t.Errorf("Expected ErrTooManyRedirects, got %v", err)
+	}
+}
+
+func TestTLSOptions(t *testing.T) {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "secure")
+	}))
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := filepath.Join(dir, "ca.pem")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw})
+	if err = ioutil.WriteFile(ca, cert, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, opts := range map[string]TLSOptions{
+		"ca bundle": {CAFile: ca},
+		"insecure":  {InsecureSkipVerify: true},
+	} {
+		f, err := NewHTTP(Options{Profile: Profile{TLS: opts}})
+		if err != nil {
+			t.Fatalf("%s: error creating fetcher: %s", name, err)
+		}
+		if resp, err := f.Fetch(NewRequest(s.URL)); err != nil || string(resp.Bytes()) != "secure" {
+			t.Errorf("%s: fetch failed: %v", name, err)
+		}
+	}
+
+	f, _ := NewHTTP(Options{})
+	if _, err := f.Fetch(NewRequest(s.URL)); err == nil {
+		t.Error("Expected an unknown certificate authority to fail")
+	}
+
+	bogus := filepath.Join(dir, "bogus.pem")
+	ioutil.WriteFile(bogus, []byte("not a certificate"), 0644)
+	if _, err := NewHTTP(Options{Profile: Profile{TLS: TLSOptions{CAFile: bogus}}}); err != ErrCABundle {
+		t.Errorf("Expected ErrCABundle, got %v", err)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	var waited time.Duration
+	sleep = func(d time.Duration) { waited += d }
+	defer func() { sleep = time.Sleep }()
+
+	l := NewLimiter(1000)
+	l.Wait(1000)
+	if waited != 0 {
+		t.Errorf("A full bucket should not wait, waited %s", waited)
+	}
+	l.Wait(500)
+	l.Wait(500)
+	if waited < 1400*time.Millisecond || waited > 1500*time.Millisecond {
+		t.Errorf("Expected to wait 1.5s for 1000 bytes on an empty bucket, waited %s", waited)
+	}
+
+	waited = 0
+	l.SetRate(0)
+	l.Wait(1 << 20)
+	if waited != 0 {
+		t.Errorf("No limit should not wait, waited %s", waited)
+	}
+	if s := l.Stats(); s.Rate != 0 || s.Bytes != 2000+1<<20 {
+		t.Errorf("Unexpected stats %+v", s)
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+	var waited time.Duration
+	sleep = func(d time.Duration) { waited += d }
+	defer func() { sleep = time.Sleep }()
+
+	body := strings.Repeat("x", 3000)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, body)
+	}))
+	defer s.Close()
+
+	if DomainBandwidth("bandwidth.test") != nil {
+		t.Error("Expected no Limiter before Bandwidth")
+	}
+	l := Bandwidth("bandwidth.test", 1000)
+	if Bandwidth("bandwidth.test", 5) != l || DomainBandwidth("bandwidth.test") != l || l.Rate() != 1000 {
+		t.Fatalf("Expected the domain Limiter to be shared and keep its rate")
+	}
+	f, err := New("http", Options{Bandwidth: l})
+	if err != nil {
+		t.Fatalf("Error creating fetcher: %s", err)
+	}
+	resp, err := f.Fetch(NewRequest(s.URL))
+	if err != nil || string(resp.Bytes()) != body {
+		t.Fatalf("Error fetching: %v", err)
+	}
+	if waited < 1900*time.Millisecond {
+		t.Errorf("Expected about 2s of waits for 3000 bytes at 1000 bytes/s, waited %s", waited)
+	}
+	stats := BandwidthStats()
+	if stats["bandwidth.test"].Bytes != 3000 || stats["*"].Bytes < 3000 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
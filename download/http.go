@@ -0,0 +1,173 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"time"
+)
+
+// HTTPFetcher downloads with net/http. Connections are kept alive and pooled
+// per host, cookies persist across requests through Options.Jar.
+type HTTPFetcher struct {
+	client *http.Client
+	opts   Options
+}
+
+var _ Fetcher = new(HTTPFetcher)
+
+func NewHTTP(opts Options) (f *HTTPFetcher, err error) {
+	if opts.Jar == nil {
+		opts.Jar = NewJar()
+	}
+	tlsConfig, err := opts.TLS.Config()
+	if err != nil {
+		return
+	}
+	transport := &http.Transport{
+		TLSClientConfig: tlsConfig,
+		Proxy:           proxyFromContext,
+		DialContext: (&net.Dialer{
+			Timeout:   opts.connectTimeout(),
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: opts.connectTimeout(),
+	}
+	f = &HTTPFetcher{
+		opts: opts,
+		client: &http.Client{
+			Transport: transport,
+			Jar:       opts.Jar,
+			Timeout:   opts.timeout(),
+		},
+	}
+	f.client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= opts.maxRedirects() {
+			return ErrTooManyRedirects
+		}
+		if hops, ok := req.Context().Value(hopsKey{}).(*[]*Response); ok && req.Response != nil {
+			*hops = append(*hops, hop(via[len(via)-1], req.Response))
+		}
+		return nil
+	}
+	return
+}
+
+type hopsKey struct{}
+
+// hop keeps a redirect answer. Its body is small (net/http only salvages 2k
+// of it for connection reuse) but archives want it, too.
+func hop(req *http.Request, hresp *http.Response) (h *Response) {
+	h = &Response{
+		URL:          req.URL.String(),
+		EffectiveURL: req.URL.String(),
+		StatusCode:   hresp.StatusCode,
+		Header:       hresp.Header,
+		ContentType:  hresp.Header.Get("Content-Type"),
+		Proto:        hresp.Proto,
+	}
+	data, _ := ioutil.ReadAll(io.LimitReader(hresp.Body, sniffLen))
+	h.SetBody(data)
+	return
+}
+
+func (f *HTTPFetcher) Fetch(req *Request) (resp *Response, err error) {
+	// A HEAD answer that already breaks the limits saves the GET, anything
+	// else (405 included) is left for the GET to find out
+	if f.opts.Preflight && req.method() == "GET" {
+		if resp, err := f.fetch("HEAD", req); err == ErrTooLarge || err == ErrContentType {
+			return resp, err
+		}
+	}
+	return f.fetch(req.method(), req)
+}
+
+func (f *HTTPFetcher) fetch(method string, req *Request) (resp *Response, err error) {
+	var body io.Reader
+	if len(req.Body) > 0 && method != "HEAD" {
+		body = bytes.NewReader(req.Body)
+	}
+	hreq, err := http.NewRequest(method, req.URL, body)
+	if err != nil {
+		return
+	}
+	for k, v := range req.Header {
+		hreq.Header[k] = v
+	}
+	f.opts.setHeader(hreq.Header)
+
+	start := time.Now()
+	resp = &Response{URL: req.URL, Date: start}
+	// Every request of the redirect chain goes through the trace, sent
+	// collects the headers of each
+	var sent []http.Header
+	header := make(http.Header)
+	trace := &httptrace.ClientTrace{
+		DNSDone:          func(httptrace.DNSDoneInfo) { resp.Timing.NameLookup = time.Since(start) },
+		ConnectDone:      func(string, string, error) { resp.Timing.Connect = time.Since(start) },
+		GotConn:          func(info httptrace.GotConnInfo) { resp.RemoteAddr = info.Conn.RemoteAddr().String() },
+		WroteHeaderField: func(key string, value []string) { header[key] = append(header[key], value...) },
+		WroteHeaders: func() {
+			resp.Timing.PreTransfer = time.Since(start)
+			sent, header = append(sent, header), make(http.Header)
+		},
+		GotFirstResponseByte: func() { resp.Timing.StartTransfer = time.Since(start) },
+	}
+	ctx := httptrace.WithClientTrace(hreq.Context(), trace)
+	ctx = context.WithValue(ctx, hopsKey{}, &resp.Redirects)
+
+	var proxy *Proxy
+	if f.opts.Proxies != nil {
+		if proxy, err = f.opts.Proxies.Pick(); err != nil {
+			return nil, err
+		}
+		ctx = withProxy(ctx, proxy)
+	}
+	hreq = hreq.WithContext(ctx)
+
+	hresp, err := f.client.Do(hreq)
+	if proxy != nil {
+		proxy.Report(time.Since(start), err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer hresp.Body.Close()
+
+	resp.EffectiveURL = hresp.Request.URL.String()
+	resp.Proto = hresp.Proto
+	for i, h := range resp.Redirects {
+		if i < len(sent) {
+			h.RequestHeader = sent[i]
+		}
+	}
+	if len(sent) > 0 {
+		resp.RequestHeader = sent[len(sent)-1]
+	}
+	resp.StatusCode = hresp.StatusCode
+	resp.Header = hresp.Header
+	resp.ContentType = hresp.Header.Get("Content-Type")
+	if err = f.opts.checkHeader(resp, hresp.ContentLength); err == nil {
+		err = f.opts.readBody(resp, throttledReader{hresp.Body, f.opts})
+	}
+	resp.Timing.Total = time.Since(start)
+	switch err {
+	case nil:
+	case ErrTooLarge, ErrContentType:
+		if resp.Body == nil {
+			resp.SetBody(nil)
+		}
+		countSkipped(err)
+	default:
+		return nil, err
+	}
+	Stats.Add("requests", 1)
+	Stats.Add("bytes", resp.Size)
+	return
+}
@@ -0,0 +1,204 @@
+package download
+
+import (
+	"bufio"
+	"code.google.com/p/go.net/publicsuffix"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Jar is an http.CookieJar whose contents can be exported and loaded again,
+// so a domain's session survives restarts. Cookies handed out by All carry
+// their scope in Domain the way Netscape cookie files do: a leading dot for
+// cookies valid on subdomains, a bare host name for host-only cookies.
+type Jar struct {
+	jar     *cookiejar.Jar
+	mutex   sync.Mutex
+	cookies map[string]*http.Cookie
+	dirty   bool
+}
+
+var _ http.CookieJar = new(Jar)
+
+var ErrCookieFormat = errors.New("Malformed cookie file line")
+
+func NewJar() (j *Jar) {
+	j = &Jar{
+		cookies: make(map[string]*http.Cookie),
+	}
+	// Turns out cookiejar.New() returns a nil error
+	j.jar, _ = cookiejar.New(&cookiejar.Options{
+		PublicSuffixList: publicsuffix.List,
+	})
+	return
+}
+
+func (j *Jar) Cookies(u *url.URL) []*http.Cookie {
+	return j.jar.Cookies(u)
+}
+
+func (j *Jar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.jar.SetCookies(u, cookies)
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	now := time.Now()
+	host := strings.ToLower(u.Hostname())
+	for _, c := range cookies {
+		stored := *c
+		stored.Raw, stored.Unparsed = "", nil
+		if stored.Domain == "" {
+			stored.Domain = host
+		} else {
+			domain := strings.ToLower(strings.TrimPrefix(stored.Domain, "."))
+			if ps, _ := publicsuffix.PublicSuffix(domain); ps == domain || !domainMatch(host, domain) {
+				// cookiejar rejected it, too
+				continue
+			}
+			stored.Domain = "." + domain
+		}
+		if stored.Path == "" || stored.Path[0] != '/' {
+			stored.Path = defaultPath(u.Path)
+		}
+		if stored.MaxAge > 0 {
+			stored.Expires = now.Add(time.Duration(stored.MaxAge) * time.Second)
+			stored.MaxAge = 0
+		}
+
+		key := stored.Domain + ";" + stored.Path + ";" + stored.Name
+		if c.MaxAge < 0 || (!stored.Expires.IsZero() && stored.Expires.Before(now)) {
+			if _, ok := j.cookies[key]; ok {
+				delete(j.cookies, key)
+				j.dirty = true
+			}
+			continue
+		}
+		j.cookies[key] = &stored
+		j.dirty = true
+	}
+}
+
+// All returns every unexpired cookie in the jar and marks the jar clean.
+func (j *Jar) All() (cookies []*http.Cookie) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	now := time.Now()
+	cookies = make([]*http.Cookie, 0, len(j.cookies))
+	for key, c := range j.cookies {
+		if !c.Expires.IsZero() && c.Expires.Before(now) {
+			delete(j.cookies, key)
+			continue
+		}
+		copied := *c
+		cookies = append(cookies, &copied)
+	}
+	j.dirty = false
+	return
+}
+
+// Dirty reports whether cookies were set or removed since the last call to
+// All.
+func (j *Jar) Dirty() bool {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.dirty
+}
+
+// Load adds cookies in the format returned by All. It does not mark the jar
+// dirty, cookies loaded from storage need not be saved again.
+func (j *Jar) Load(cookies []*http.Cookie) {
+	j.mutex.Lock()
+	dirty := j.dirty
+	j.mutex.Unlock()
+	defer func() {
+		j.mutex.Lock()
+		j.dirty = dirty
+		j.mutex.Unlock()
+	}()
+
+	for _, c := range cookies {
+		host := strings.TrimPrefix(c.Domain, ".")
+		if host == "" {
+			continue
+		}
+		u := &url.URL{Scheme: "http", Host: host, Path: c.Path}
+		if c.Secure {
+			u.Scheme = "https"
+		}
+		set := *c
+		if !strings.HasPrefix(c.Domain, ".") {
+			set.Domain = ""
+		}
+		j.SetCookies(u, []*http.Cookie{&set})
+	}
+}
+
+// ReadNetscapeCookies parses a Netscape/Mozilla cookies.txt file, as written
+// by curl and most browser export extensions.
+func ReadNetscapeCookies(r io.Reader) (cookies []*http.Cookie, err error) {
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		httpOnly := false
+		if strings.HasPrefix(line, "#HttpOnly_") {
+			line, httpOnly = line[len("#HttpOnly_"):], true
+		}
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			return nil, ErrCookieFormat
+		}
+		expires, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return nil, ErrCookieFormat
+		}
+		c := &http.Cookie{
+			Domain:   strings.ToLower(strings.TrimPrefix(fields[0], ".")),
+			Path:     fields[2],
+			Secure:   strings.EqualFold(fields[3], "TRUE"),
+			Name:     fields[5],
+			Value:    fields[6],
+			HttpOnly: httpOnly,
+		}
+		if strings.EqualFold(fields[1], "TRUE") {
+			c.Domain = "." + c.Domain
+		}
+		if expires > 0 {
+			c.Expires = time.Unix(expires, 0)
+		}
+		cookies = append(cookies, c)
+	}
+	return cookies, s.Err()
+}
+
+// CookieMatches reports whether a cookie in the format returned by All would
+// be sent to host or any of its subdomains.
+func CookieMatches(c *http.Cookie, host string) bool {
+	domain := strings.TrimPrefix(c.Domain, ".")
+	return domainMatch(domain, host) || domainMatch(host, domain)
+}
+
+func domainMatch(host, domain string) bool {
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+func defaultPath(p string) string {
+	if p == "" || p[0] != '/' {
+		return "/"
+	}
+	if dir := path.Dir(p); dir != "." {
+		return dir
+	}
+	return "/"
+}
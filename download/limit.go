@@ -0,0 +1,101 @@
+package download
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+const sniffLen = 512
+
+var (
+	ErrTooLarge    = errors.New("Body too large")
+	ErrContentType = errors.New("Content type not allowed")
+)
+
+// Defaults for domains that do not set their own limits
+var (
+	DefaultMaxBodySize  int64 = 10 << 20
+	DefaultContentTypes       = []string{"text/html", "application/xhtml+xml"}
+)
+
+// allowType reports whether contentType is on the Options.ContentTypes
+// allowlist. Entries are media types, "text/*" allows a whole family.
+func (o Options) allowType(contentType string) bool {
+	if len(o.ContentTypes) == 0 {
+		return true
+	}
+	media, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		media = strings.ToLower(strings.TrimSpace(contentType))
+	}
+	for _, allowed := range o.ContentTypes {
+		allowed = strings.ToLower(allowed)
+		if allowed == media || allowed == "*/*" {
+			return true
+		}
+		if strings.HasSuffix(allowed, "/*") && strings.HasPrefix(media, allowed[:len(allowed)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkHeader looks at the headers of a response before its body is read.
+// A 2xx answer must declare an allowed type (if it declares one at all) and
+// a Content-Length within MaxBodySize.
+func (o Options) checkHeader(resp *Response, contentLength int64) error {
+	if o.MaxBodySize > 0 && contentLength > o.MaxBodySize {
+		return ErrTooLarge
+	}
+	if resp.OK() && resp.ContentType != "" && !o.allowType(resp.ContentType) {
+		return ErrContentType
+	}
+	return nil
+}
+
+// readBody reads the body of resp from r, keeping to the limits of o. Without
+// a Content-Type header the type is sniffed from the first bytes. Whatever
+// was read before a limit hit stays in resp.
+func (o Options) readBody(resp *Response, r io.Reader) (err error) {
+	var buf bytes.Buffer
+	if resp.ContentType == "" {
+		if _, err = io.CopyN(&buf, r, sniffLen); err != nil && err != io.EOF {
+			return
+		}
+		if buf.Len() > 0 {
+			resp.ContentType = http.DetectContentType(buf.Bytes())
+		}
+		if resp.OK() && buf.Len() > 0 && !o.allowType(resp.ContentType) {
+			resp.SetBody(nil)
+			return ErrContentType
+		}
+	}
+
+	if o.MaxBodySize > 0 {
+		r = io.LimitReader(r, o.MaxBodySize+1-int64(buf.Len()))
+	}
+	if _, err = buf.ReadFrom(r); err != nil {
+		return
+	}
+	data := buf.Bytes()
+	if o.MaxBodySize > 0 && int64(len(data)) > o.MaxBodySize {
+		resp.SetBody(data[:o.MaxBodySize])
+		return ErrTooLarge
+	}
+	resp.SetBody(data)
+	return
+}
+
+// countSkipped keeps Stats of responses cut short by the limits.
+func countSkipped(err error) {
+	switch err {
+	case ErrTooLarge:
+		Stats.Add("too_large", 1)
+	case ErrContentType:
+		Stats.Add("content_type", 1)
+	}
+}
@@ -0,0 +1,103 @@
+package download
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// Profile is the part of Options describing how to talk to a site. Unlike
+// the rest of Options it is plain data, so domains keep it with their config.
+type Profile struct {
+	Header         http.Header   // Sent with every request, e.g. Referer or Accept-Language
+	UserAgents     []string      // One is picked per request, defaults to UserAgent
+	Timeout        time.Duration // Whole request including body, defaults to DefaultTimeout
+	ConnectTimeout time.Duration // TCP connect and TLS handshake, defaults to DefaultConnectTimeout
+	MaxRedirects   int           // Redirects to follow, defaults to DefaultMaxRedirects
+	TLS            TLSOptions
+}
+
+// TLSOptions adjust certificate handling for HTTPS sites.
+type TLSOptions struct {
+	CAFile             string // PEM bundle of CAs to trust on top of the system ones
+	CertFile           string // PEM client certificate
+	KeyFile            string // PEM key of CertFile
+	InsecureSkipVerify bool   // Accept any server certificate; internal hosts only
+}
+
+var ErrCABundle = errors.New("No certificates found in CA bundle")
+
+// Config builds the tls.Config for o, nil if o is the zero value.
+func (o TLSOptions) Config() (c *tls.Config, err error) {
+	if o == (TLSOptions{}) {
+		return
+	}
+	c = &tls.Config{
+		InsecureSkipVerify: o.InsecureSkipVerify,
+	}
+	if o.CAFile != "" {
+		pem, err := ioutil.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		if c.RootCAs, err = x509.SystemCertPool(); err != nil || c.RootCAs == nil {
+			c.RootCAs = x509.NewCertPool()
+		}
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, ErrCABundle
+		}
+	}
+	if o.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return
+}
+
+// setHeader adds the profile's headers and a User-Agent to h, leaving alone
+// whatever the request set itself.
+func (p Profile) setHeader(h http.Header) {
+	for k, v := range p.Header {
+		if k = http.CanonicalHeaderKey(k); len(h[k]) == 0 {
+			h[k] = v
+		}
+	}
+	if h.Get("User-Agent") == "" {
+		h.Set("User-Agent", p.userAgent())
+	}
+}
+
+func (p Profile) userAgent() string {
+	if len(p.UserAgents) > 0 {
+		return p.UserAgents[rand.Intn(len(p.UserAgents))]
+	}
+	return UserAgent
+}
+
+func (p Profile) timeout() time.Duration {
+	if p.Timeout > 0 {
+		return p.Timeout
+	}
+	return DefaultTimeout
+}
+
+func (p Profile) connectTimeout() time.Duration {
+	if p.ConnectTimeout > 0 {
+		return p.ConnectTimeout
+	}
+	return DefaultConnectTimeout
+}
+
+func (p Profile) maxRedirects() int {
+	if p.MaxRedirects > 0 {
+		return p.MaxRedirects
+	}
+	return DefaultMaxRedirects
+}
@@ -0,0 +1,52 @@
+package download
+
+import (
+	"logger"
+	"sync"
+)
+
+// Recorder archives fetches, see the warc package. Once set it sees every
+// fetch of every Fetcher New creates afterwards, except Secret requests.
+type Recorder interface {
+	// Record is called for every fetch that got an answer. err is the error
+	// the fetch returned along with resp, such as ErrTooLarge.
+	Record(req *Request, resp *Response, err error) error
+}
+
+var (
+	recorderMu sync.RWMutex
+	recorder   Recorder
+)
+
+type recordFetcher struct {
+	fetcher  Fetcher
+	recorder Recorder
+}
+
+var _ Fetcher = new(recordFetcher)
+
+// SetRecorder makes New wrap the Fetchers it creates so r records their
+// traffic. nil stops recording for Fetchers created from then on.
+func SetRecorder(r Recorder) {
+	recorderMu.Lock()
+	defer recorderMu.Unlock()
+	recorder = r
+}
+
+func getRecorder() Recorder {
+	recorderMu.RLock()
+	defer recorderMu.RUnlock()
+	return recorder
+}
+
+func (f *recordFetcher) Fetch(req *Request) (resp *Response, err error) {
+	resp, err = f.fetcher.Fetch(req)
+	if resp == nil || req.Secret {
+		return
+	}
+	// Failing to archive is no reason to fail the crawl
+	if rerr := f.recorder.Record(req, resp, err); rerr != nil {
+		logger.Error.Printf("Error recording %s: %s", req.URL, rerr)
+	}
+	return
+}
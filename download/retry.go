@@ -0,0 +1,129 @@
+package download
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy decides how often and how patiently a failed fetch is retried.
+// Only temporary failures are retried, see Temporary.
+type RetryPolicy struct {
+	MaxAttempts int           // Tries including the first one; 1 or less never retries
+	BaseDelay   time.Duration // Wait before the first retry, doubled for every further one
+	MaxDelay    time.Duration // Longest single wait; a longer Retry-After gives up instead
+	Jitter      float64       // Fraction (0-1) of every wait that is randomised
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	BaseDelay:   2 * time.Second,
+	MaxDelay:    2 * time.Minute,
+	Jitter:      0.5,
+}
+
+// Delay returns how long to wait before retrying after attempt failed. A
+// Retry-After header on resp is honoured; ok is false if it asks for a longer
+// wait than MaxDelay.
+func (p RetryPolicy) Delay(attempt int, resp *Response) (delay time.Duration, ok bool) {
+	delay = p.BaseDelay << uint(attempt-1)
+	if delay <= 0 || (p.MaxDelay > 0 && delay > p.MaxDelay) {
+		delay = p.MaxDelay
+	}
+	if p.Jitter > 0 {
+		delay -= time.Duration(rand.Float64() * p.Jitter * float64(delay))
+	}
+
+	if resp != nil {
+		if after, found := RetryAfter(resp.Header, time.Now()); found {
+			if p.MaxDelay > 0 && after > p.MaxDelay {
+				return 0, false
+			}
+			if after > delay {
+				delay = after
+			}
+		}
+	}
+	return delay, true
+}
+
+// RetryAfter parses a Retry-After header, given either in seconds or as an
+// HTTP date.
+func RetryAfter(h http.Header, now time.Time) (d time.Duration, ok bool) {
+	v := h.Get("Retry-After")
+	if v == "" {
+		return
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			secs = 0
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d = t.Sub(now); d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return
+}
+
+// Temporary reports whether the outcome of a fetch is worth retrying:
+// timeouts, dropped or refused connections, 408, 429 and 5xx answers. DNS
+// failures for names that do not exist, redirect loops and other 4xx answers
+// are permanent.
+func Temporary(resp *Response, err error) bool {
+	if err != nil {
+		return temporaryError(err)
+	}
+	if resp == nil {
+		return false
+	}
+	switch code := resp.StatusCode; {
+	case code == http.StatusRequestTimeout, code == http.StatusTooManyRequests:
+		return true
+	case code == http.StatusNotImplemented, code == http.StatusHTTPVersionNotSupported:
+		return false
+	case code >= 500:
+		return true
+	}
+	return false
+}
+
+func temporaryError(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return !dnsErr.IsNotFound && (dnsErr.IsTimeout || dnsErr.IsTemporary)
+	}
+	if errors.Is(err, ErrTooManyRedirects) {
+		return false
+	}
+	if errors.Is(err, ErrNoProxy) {
+		// Over once a proxy cooled down
+		return true
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	for _, temp := range []error{
+		io.EOF,
+		io.ErrUnexpectedEOF,
+		syscall.ECONNRESET,
+		syscall.ECONNREFUSED,
+		syscall.ECONNABORTED,
+		syscall.EPIPE,
+		syscall.ETIMEDOUT,
+	} {
+		if errors.Is(err, temp) {
+			return true
+		}
+	}
+	return false
+}
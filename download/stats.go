@@ -0,0 +1,14 @@
+package download
+
+import (
+	"expvar"
+)
+
+// Stats holds process-wide transfer counters. Being an expvar it is served as
+// JSON under /debug/vars by any http.DefaultServeMux listener.
+//
+//	requests     responses received
+//	bytes        body bytes received
+//	not_modified 304 answers to conditional requests
+//	bytes_saved  body bytes those 304s did not have to transfer
+var Stats = expvar.NewMap("download")
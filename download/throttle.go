@@ -0,0 +1,191 @@
+package download
+
+import (
+	"expvar"
+	"io"
+	"sync"
+	"time"
+)
+
+// Largest read between two waits, so a throttled body arrives steadily
+// rather than in bursts
+const throttleChunk = 16 << 10
+
+// Limiter is a token bucket capping the bytes per second read through it,
+// with bursts of up to one second's worth. It also measures the throughput
+// it sees, limited or not.
+type Limiter struct {
+	mutex      sync.Mutex
+	rate       int64 // Bytes per second, 0 for no limit
+	tokens     float64
+	last       time.Time
+	total      int64
+	count      int64 // Bytes since since
+	since      time.Time
+	throughput float64
+}
+
+// LimiterStats is a snapshot of a Limiter.
+type LimiterStats struct {
+	Rate       int64   // Limit in bytes per second, 0 for none
+	Bytes      int64   // Read in total
+	Throughput float64 // Bytes per second over the last second or so
+}
+
+// Global limits the bandwidth of the whole process. It applies to every
+// Fetcher on top of Options.Bandwidth.
+var Global = NewLimiter(0)
+
+// Replaced in tests
+var sleep = time.Sleep
+
+var (
+	limitersMu sync.Mutex
+	limiters   = make(map[string]*Limiter)
+)
+
+func init() {
+	expvar.Publish("bandwidth", expvar.Func(func() interface{} {
+		return BandwidthStats()
+	}))
+}
+
+// NewLimiter returns a Limiter allowing rate bytes per second, 0 for no
+// limit.
+func NewLimiter(rate int64) *Limiter {
+	now := time.Now()
+	return &Limiter{
+		rate:   rate,
+		tokens: float64(rate),
+		last:   now,
+		since:  now,
+	}
+}
+
+// Bandwidth returns the Limiter shared by everything fetching from the named
+// domain, creating it with rate on first use. Later calls leave the rate
+// alone, so it can be changed at runtime through SetRate.
+func Bandwidth(name string, rate int64) *Limiter {
+	limitersMu.Lock()
+	defer limitersMu.Unlock()
+	l, ok := limiters[name]
+	if !ok {
+		l = NewLimiter(rate)
+		limiters[name] = l
+	}
+	return l
+}
+
+// DomainBandwidth returns the Limiter Bandwidth created for the named
+// domain, nil if there is none.
+func DomainBandwidth(name string) *Limiter {
+	limitersMu.Lock()
+	defer limitersMu.Unlock()
+	return limiters[name]
+}
+
+// BandwidthStats returns the stats of Global under "*" and of every domain
+// Limiter under its name.
+func BandwidthStats() (stats map[string]LimiterStats) {
+	limitersMu.Lock()
+	defer limitersMu.Unlock()
+	stats = make(map[string]LimiterStats, len(limiters)+1)
+	stats["*"] = Global.Stats()
+	for name, l := range limiters {
+		stats[name] = l.Stats()
+	}
+	return
+}
+
+// SetRate changes the limit to rate bytes per second, 0 for none.
+func (l *Limiter) SetRate(rate int64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.refill(time.Now())
+	l.rate = rate
+	if l.tokens > float64(rate) {
+		l.tokens = float64(rate)
+	}
+}
+
+func (l *Limiter) Rate() int64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.rate
+}
+
+func (l *Limiter) Stats() LimiterStats {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.measure(time.Now())
+	return LimiterStats{
+		Rate:       l.rate,
+		Bytes:      l.total,
+		Throughput: l.throughput,
+	}
+}
+
+// Wait takes n bytes worth of tokens, sleeping until the bucket has paid them
+// back if it ran dry. Concurrent readers queue up behind each other's debt.
+func (l *Limiter) Wait(n int) {
+	l.mutex.Lock()
+	now := time.Now()
+	l.total += int64(n)
+	l.count += int64(n)
+	l.measure(now)
+	if l.rate <= 0 {
+		l.mutex.Unlock()
+		return
+	}
+	l.refill(now)
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+	}
+	l.mutex.Unlock()
+	if delay > 0 {
+		sleep(delay)
+	}
+}
+
+func (l *Limiter) refill(now time.Time) {
+	if l.rate > 0 {
+		l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+		if l.tokens > float64(l.rate) {
+			l.tokens = float64(l.rate)
+		}
+	}
+	l.last = now
+}
+
+func (l *Limiter) measure(now time.Time) {
+	if d := now.Sub(l.since); d >= time.Second {
+		l.throughput = float64(l.count) / d.Seconds()
+		l.count, l.since = 0, now
+	}
+}
+
+// wait throttles n bytes read by a Fetcher using o.
+func (o Options) wait(n int) {
+	Global.Wait(n)
+	if o.Bandwidth != nil {
+		o.Bandwidth.Wait(n)
+	}
+}
+
+type throttledReader struct {
+	r    io.Reader
+	opts Options
+}
+
+func (t throttledReader) Read(p []byte) (n int, err error) {
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+	n, err = t.r.Read(p)
+	if n > 0 {
+		t.opts.wait(n)
+	}
+	return
+}
@@ -54,18 +54,20 @@ func (f *Feed) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	rss := new(RSS)
 	rss.Channel.Title = "RSS Feed for " + domain
-	rss.Channel.Item = make([]Item, len(pages))
+	rss.Channel.Item = make([]Item, 0, len(pages))
 	for i := range pages {
-		u := pages[i].GetURL()
-		rss.Channel.Item[i] = Item{
+		u, err := pages[i].GetURL()
+		if err != nil {
+			log.Printf("Skipping %q: %s", pages[i].URL, err)
+			continue
+		}
+		rss.Channel.Item = append(rss.Channel.Item, Item{
 			Guid:    u.String(),
 			Link:    u.String(),
-			PubDate: pages[i].FirstDownload,
+			PubDate: pages[i].FirstDownload.Truncate(time.Second), // Whole seconds
 			Source:  "CoverageSpider",
 			Title:   pages[i].Title,
-		}
-		// Knock down to whole seconds
-		rss.Channel.Item[i].PubDate = rss.Channel.Item[i].PubDate.Add(time.Duration(-pages[i].FirstDownload.Nanosecond()))
+		})
 	}
 
 	enc := xml.NewEncoder(w)
@@ -0,0 +1,173 @@
+// Package login signs a crawler in to sites that hide content behind a form.
+// The session ends up in the cookie jar of the Fetcher used, so every later
+// request through it is authenticated.
+package login
+
+import (
+	"bytes"
+	"download"
+	"errors"
+	"github.com/PuerkitoBio/goquery"
+	"net/url"
+	"strings"
+)
+
+// Config declares a login flow: the form at URL is submitted with Fields
+// filled in, keeping whatever hidden inputs (CSRF tokens and such) it has.
+type Config struct {
+	URL       string            // Page holding the login form
+	Form      string            // Selector of the form, defaults to the first one with a password input
+	Fields    map[string]string // Values to submit, by input name
+	Success   string            // Selector only found on the page after a successful login
+	Redirect  string            // URL (or prefix) a successful login ends up at
+	LoggedOut string            // Text only found on pages served to logged out users
+}
+
+var (
+	ErrNoForm    = errors.New("Login form not found")
+	ErrFailed    = errors.New("Login failed")
+	ErrLoggedOut = errors.New("Logged out and could not log in again")
+)
+
+// Login runs the flow of c with f. Without Success or Redirect set, a login
+// counts as failed when the answer still holds a password input.
+func Login(f download.Fetcher, c Config) (err error) {
+	resp, err := f.Fetch(download.NewRequest(c.URL))
+	if err != nil {
+		return
+	}
+	if !resp.OK() {
+		return ErrNoForm
+	}
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(resp.Bytes()))
+	if err != nil {
+		return
+	}
+	form := findForm(doc, c.Form)
+	if form == nil {
+		return ErrNoForm
+	}
+
+	base, err := url.Parse(resp.EffectiveURL)
+	if err != nil {
+		return
+	}
+	action, _ := form.Attr("action")
+	target, err := base.Parse(action)
+	if err != nil {
+		return
+	}
+	values := formValues(form)
+	for name, value := range c.Fields {
+		values.Set(name, value)
+	}
+
+	var req *download.Request
+	if method, _ := form.Attr("method"); strings.EqualFold(method, "post") {
+		req = download.NewFormRequest(target.String(), values)
+	} else {
+		target.RawQuery = values.Encode()
+		req = download.NewRequest(target.String())
+	}
+	// The password is in the body or the query string
+	req.Secret = true
+	req.Header.Set("Referer", resp.EffectiveURL)
+	if resp, err = f.Fetch(req); err != nil {
+		return
+	}
+	if !resp.OK() || !c.succeeded(resp) {
+		return ErrFailed
+	}
+	return
+}
+
+// IsLoggedOut reports whether body carries the LoggedOut marker, meaning the
+// session expired and Login has to run again.
+func (c Config) IsLoggedOut(body string) bool {
+	return c.LoggedOut != "" && strings.Contains(body, c.LoggedOut)
+}
+
+func (c Config) succeeded(resp *download.Response) bool {
+	if c.Redirect != "" {
+		u, err := url.Parse(resp.URL)
+		if err != nil {
+			return false
+		}
+		if r, err := u.Parse(c.Redirect); err != nil || !strings.HasPrefix(resp.EffectiveURL, r.String()) {
+			return false
+		}
+	}
+	if c.IsLoggedOut(string(resp.Bytes())) {
+		return false
+	}
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(resp.Bytes()))
+	if err != nil {
+		return false
+	}
+	switch {
+	case c.Success != "":
+		return doc.Find(c.Success).Length() > 0
+	case c.Redirect != "":
+		return true
+	}
+	return doc.Find(`input[type="password"]`).Length() == 0
+}
+
+func findForm(doc *goquery.Document, selector string) *goquery.Selection {
+	var forms *goquery.Selection
+	if selector != "" {
+		forms = doc.Find(selector)
+	} else {
+		forms = doc.Find("form").FilterFunction(func(i int, s *goquery.Selection) bool {
+			return s.Find(`input[type="password"]`).Length() > 0
+		})
+	}
+	if forms.Length() == 0 {
+		return nil
+	}
+	return forms.First()
+}
+
+// formValues collects what a browser would submit for form without the user
+// touching it. Submit buttons are left out.
+func formValues(form *goquery.Selection) (values url.Values) {
+	values = make(url.Values)
+	form.Find("input[name], select[name], textarea[name]").Each(func(i int, s *goquery.Selection) {
+		name, _ := s.Attr("name")
+		if _, disabled := s.Attr("disabled"); disabled {
+			return
+		}
+		switch {
+		case s.Is("select"):
+			opt := s.Find("option[selected]").First()
+			if opt.Length() == 0 {
+				opt = s.Find("option").First()
+			}
+			if opt.Length() > 0 {
+				value, ok := opt.Attr("value")
+				if !ok {
+					value = opt.Text()
+				}
+				values.Add(name, value)
+			}
+			return
+		case s.Is("textarea"):
+			values.Add(name, s.Text())
+			return
+		}
+		value, _ := s.Attr("value")
+		switch typ, _ := s.Attr("type"); strings.ToLower(typ) {
+		case "submit", "button", "image", "reset", "file":
+		case "checkbox", "radio":
+			if _, checked := s.Attr("checked"); checked {
+				if value == "" {
+					value = "on"
+				}
+				values.Add(name, value)
+			}
+		default:
+			values.Add(name, value)
+		}
+	})
+	return
+}
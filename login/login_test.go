@@ -0,0 +1,122 @@
+package login
+
+import (
+	"download"
+	"fmt"
+	"launchpad.net/gocheck"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type LoginSuite struct {
+	ts *httptest.Server
+}
+
+var _ = gocheck.Suite(new(LoginSuite))
+
+func Test(t *testing.T) { gocheck.TestingT(t) }
+
+func (s *LoginSuite) SetUpSuite(c *gocheck.C) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			if r.FormValue("csrf") != "t0k3n" || r.FormValue("remember") != "1" {
+				http.Error(w, "Bad token", http.StatusForbidden)
+				return
+			}
+			if r.FormValue("user") != "moko" || r.FormValue("pass") != "secret" {
+				http.Redirect(w, r, "/login?failed", http.StatusFound)
+				return
+			}
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "ok", Path: "/"})
+			http.Redirect(w, r, "/home", http.StatusFound)
+			return
+		}
+		fmt.Fprint(w, `<html><body>
+			<form action="/search"><input name="q"></form>
+			<form action="/login" method="post">
+				<input type="hidden" name="csrf" value="t0k3n">
+				<input type="text" name="user">
+				<input type="password" name="pass">
+				<input type="checkbox" name="remember" value="1" checked>
+				<input type="submit" name="go" value="Log in">
+			</form>
+		</body></html>`)
+	})
+	mux.HandleFunc("/home", func(w http.ResponseWriter, r *http.Request) {
+		if c, err := r.Cookie("session"); err == nil && c.Value == "ok" {
+			fmt.Fprint(w, `<div id="account">Welcome</div>`)
+			return
+		}
+		fmt.Fprint(w, `Please log in`)
+	})
+	s.ts = httptest.NewServer(mux)
+}
+
+func (s *LoginSuite) TearDownSuite(c *gocheck.C) {
+	s.ts.Close()
+}
+
+func (s *LoginSuite) config() Config {
+	return Config{
+		URL:       s.ts.URL + "/login",
+		Fields:    map[string]string{"user": "moko", "pass": "secret"},
+		LoggedOut: "Please log in",
+	}
+}
+
+func (s *LoginSuite) TestLogin(c *gocheck.C) {
+	for _, cfg := range []Config{
+		s.config(),
+		func() Config { cfg := s.config(); cfg.Redirect = "/home"; return cfg }(),
+		func() Config { cfg := s.config(); cfg.Success = "#account"; return cfg }(),
+	} {
+		f, err := download.New("http", download.Options{})
+		c.Assert(err, gocheck.IsNil)
+		c.Assert(Login(f, cfg), gocheck.IsNil)
+
+		resp, err := f.Fetch(download.NewRequest(s.ts.URL + "/home"))
+		c.Assert(err, gocheck.IsNil)
+		c.Assert(cfg.IsLoggedOut(string(resp.Bytes())), gocheck.Equals, false)
+	}
+}
+
+func (s *LoginSuite) TestFailed(c *gocheck.C) {
+	f, err := download.New("http", download.Options{})
+	c.Assert(err, gocheck.IsNil)
+
+	cfg := s.config()
+	cfg.Fields["pass"] = "wrong"
+	c.Assert(Login(f, cfg), gocheck.Equals, ErrFailed)
+
+	resp, err := f.Fetch(download.NewRequest(s.ts.URL + "/home"))
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(cfg.IsLoggedOut(string(resp.Bytes())), gocheck.Equals, true)
+
+	cfg = s.config()
+	cfg.URL = s.ts.URL + "/home"
+	c.Assert(Login(f, cfg), gocheck.Equals, ErrNoForm)
+}
+
+// recorder keeps what it is asked to record.
+type recorder []*download.Request
+
+func (r *recorder) Record(req *download.Request, resp *download.Response, err error) error {
+	*r = append(*r, req)
+	return nil
+}
+
+func (s *LoginSuite) TestNotRecorded(c *gocheck.C) {
+	var r recorder
+	download.SetRecorder(&r)
+	defer download.SetRecorder(nil)
+	f, err := download.New("http", download.Options{})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(Login(f, s.config()), gocheck.IsNil)
+
+	// The login page is, the form with the password is not
+	c.Assert(r, gocheck.HasLen, 1)
+	c.Check(r[0].URL, gocheck.Equals, s.ts.URL+"/login")
+	c.Check(r[0].Body, gocheck.IsNil)
+}
@@ -6,17 +6,22 @@ package main
 import (
 	"config"
 	"domain"
+	"download"
 	"encoding/json"
 	"feed"
 	"flag"
+	"fmt"
 	"log"
 	"logger"
+	"login"
 	"net/http"
 	"os"
 	"page"
 	"queue"
 	"scheduler"
 	"storage"
+	"strconv"
+	"warc"
 )
 
 var (
@@ -30,18 +35,144 @@ var (
 	once            = flag.Bool("once", true, "Only crawl sites once, then stop")
 	listen          = flag.String("listen", ":8084", "Address:port to listen for HTTP requests")
 	printConf       = flag.Bool("printconfig", false, "Print configuration from store and exit")
+	validate        = flag.Bool("validate", false, "Check the configuration from store, domains reachable included, and exit")
 	rssOnly         = flag.Bool("rssonly", false, "Only run the web interface for RSS exports (don't spider)")
+	fetcher         = flag.String("fetcher", "http", "Downloader to use - http, curl (curl needs a build with -tags curl) or replay")
+	cookieFile      = flag.String("cookies", "", "Netscape format cookies.txt to import into the matching domains' cookie jars")
+	warcDir         = flag.String("warc", "", "Directory to archive every fetch to as WARC files, with a CDX index each")
+	warcSize        = flag.Int64("warc.size", warc.DefaultMaxSize, "Size in bytes to start a new WARC file at")
+	warcGzip        = flag.Bool("warc.gzip", true, "Gzip WARC records")
+	botName         = flag.String("botname", download.BotName, "User agent to follow robots.txt rules for")
+	bandwidth       = flag.Int64("bandwidth", 0, "Bytes per second to download at across all domains, 0 for no limit; adjustable at /bandwidth")
+	replayFrom      = flag.String("replay", "", "WARC file or directory the replay fetcher answers from")
 )
 
 func Print_obj(obj interface{}, str string) {
 	enc := json.NewEncoder(os.Stdout)
 	enc.Encode(str)
 	if err := enc.Encode(obj); err != nil {
-		logger.Error.Fatalf("%s Error encoding config: %s", str, err)
+		fatalf("%s Error encoding config: %s", str, err)
 	}
 
 }
 
+// importCookies adds the cookies in a Netscape cookies.txt file to the stored
+// cookie jar of every configured domain they apply to.
+func importCookies(store storage.Storage, filename string) (err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	cookies, err := download.ReadNetscapeCookies(f)
+	if err != nil {
+		return
+	}
+
+	c := new(config.Config)
+	if err = store.GetConfig(c); err != nil {
+		return
+	}
+	for i := range c.Domains {
+		d := &c.Domains[i]
+		matched := make([]*http.Cookie, 0, len(cookies))
+		for _, cookie := range cookies {
+			if download.CookieMatches(cookie, d.GetURL().Host) {
+				matched = append(matched, cookie)
+			}
+		}
+		if len(matched) == 0 {
+			continue
+		}
+
+		var stored []*http.Cookie
+		if err = store.GetCookies(d.Domain(), &stored); err != nil {
+			return
+		}
+		jar := download.NewJar()
+		jar.Load(stored)
+		jar.Load(matched)
+		if err = store.SaveCookies(d.Domain(), jar.All()); err != nil {
+			return
+		}
+		logger.Info.Printf("Imported %d cookies for %s", len(matched), d.DisplayName())
+	}
+	return
+}
+
+// bandwidthHandler serves the bandwidth limits and throughput as JSON. A POST
+// with rate (bytes per second, 0 for no limit) changes the limit of domain,
+// or the global one without domain. Domains not in the config, or not
+// crawled yet, are not found.
+func bandwidthHandler(store storage.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			rate, err := strconv.ParseInt(r.FormValue("rate"), 10, 64)
+			if err != nil || rate < 0 {
+				http.Error(w, "Bad rate", http.StatusBadRequest)
+				return
+			}
+			limiter := download.Global
+			if name := r.FormValue("domain"); name != "" {
+				c := new(config.Config)
+				if err := store.GetConfig(c); err != nil {
+					logger.Error.Printf("Error getting config: %s", err)
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				limiter = nil
+				for i := range c.Domains {
+					if c.Domains[i].Domain() == name {
+						limiter = download.DomainBandwidth(name)
+						break
+					}
+				}
+				if limiter == nil {
+					http.Error(w, "Unknown domain", http.StatusNotFound)
+					return
+				}
+			}
+			limiter.SetRate(rate)
+			logger.Info.Printf("Bandwidth of %q set to %d bytes/s", r.FormValue("domain"), rate)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(download.BandwidthStats()); err != nil {
+			logger.Error.Printf("Error encoding bandwidth stats: %s", err)
+		}
+	}
+}
+
+// delayHandler serves the adaptive delays of the domains using one as JSON.
+func delayHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(domain.Delays()); err != nil {
+		logger.Error.Printf("Error encoding delays: %s", err)
+	}
+}
+
+// quarantineHandler serves the URLs of domain taken for crawler traps as
+// JSON, latest first.
+func quarantineHandler(store storage.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.FormValue("domain")
+		if name == "" {
+			http.Error(w, "Missing domain", http.StatusBadRequest)
+			return
+		}
+		var list []*storage.Quarantined
+		if err := store.GetQuarantined(name, &list); err != nil {
+			logger.Error.Printf("Error getting quarantined URLs of %s: %s", name, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(list); err != nil {
+			logger.Error.Printf("Error encoding quarantined URLs: %s", err)
+		}
+	}
+}
+
 func init() {
 	logger.Debug = log.New(os.Stdout, "  DEBUG ", logger.DefaultFlags)
 	logger.Error = log.New(os.Stderr, "  ERROR ", logger.DefaultFlags)
@@ -50,24 +181,115 @@ func init() {
 	logger.Warn = log.New(os.Stdout, "   WARN ", logger.DefaultFlags)
 }
 
+// validateConfig prints every problem with the stored configuration and
+// returns the exit status.
+func validateConfig(store storage.Storage) int {
+	c := new(config.Config)
+	if err := store.GetConfig(c); err != nil {
+		fmt.Fprintf(os.Stderr, "Error getting config: %s\n", err)
+		return 1
+	}
+	var errs config.Errors
+	if err := c.Validate(); err != nil {
+		errs = err.(config.Errors)
+	}
+	for i := range c.Domains {
+		if len(c.Domains[i].Validate()) > 0 {
+			continue
+		}
+		if err := c.Domains[i].CheckReachable(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		fmt.Fprintln(os.Stderr, errs)
+		fmt.Fprintf(os.Stderr, "%d problems found\n", len(errs))
+		return 1
+	}
+	fmt.Printf("%d domains OK\n", len(c.Domains))
+	return 0
+}
+
+// archive is the WARC writer of -warc, see exit.
+var archive *warc.Writer
+
+// closeArchive closes the WARC writer, if any, so the last records and the
+// CDX index are on disk.
+func closeArchive() {
+	if archive == nil {
+		return
+	}
+	if err := archive.Close(); err != nil {
+		logger.Error.Printf("Error closing WARC file: %s", err)
+	}
+	archive = nil
+}
+
+// exit is os.Exit after closeArchive. main exits through it, fatal and
+// fatalf, never os.Exit or logger.Error.Fatal, which skip deferred calls.
+func exit(code int) {
+	closeArchive()
+	os.Exit(code)
+}
+
+// fatal is logger.Error.Fatal by way of exit.
+func fatal(v ...interface{}) {
+	logger.Error.Output(2, fmt.Sprint(v...))
+	exit(1)
+}
+
+// fatalf is logger.Error.Fatalf by way of exit.
+func fatalf(format string, v ...interface{}) {
+	logger.Error.Output(2, fmt.Sprintf(format, v...))
+	exit(1)
+}
+
 func main() {
 	flag.Parse()
 	var err error
 
+	if *warcDir != "" {
+		w, err := warc.NewWriter(*warcDir, "pachong", *warcSize, *warcGzip)
+		if err != nil {
+			fatalf("Error opening WARC directory: %s", err)
+		}
+		archive = w
+		defer closeArchive()
+		download.SetRecorder(w)
+	}
+	download.BotName = *botName
+	download.Global.SetRate(*bandwidth)
+	if *fetcher == "replay" {
+		if *replayFrom == "" {
+			fatal("The replay fetcher needs -replay")
+		}
+		rp, err := warc.NewReplay(*replayFrom)
+		if err != nil {
+			fatalf("Error loading %s: %s", *replayFrom, err)
+		}
+		logger.Info.Printf("Replaying %d URLs from %s", rp.Len(), *replayFrom)
+		download.Register("replay", func(download.Options) (download.Fetcher, error) {
+			return rp, nil
+		})
+	}
+	if err = download.SetDefault(*fetcher); err != nil {
+		fatalf("Fetcher %s: %s", *fetcher, err)
+	}
+
 	// Set up storage backend
 	var store storage.Storage
 	switch {
 	case *storeMysql != "":
 		if store, err = storage.NewMySQL(*storeMysql); err != nil {
-			logger.Error.Fatal(err)
+			fatal(err)
 		}
 	case *storeMongo != "":
 		//if store, err = storage.NewMongo(*storeMongo, *storeMongoShard); err != nil {
-		//	logger.Error.Fatal(err)
+		//	fatal(err)
 		//}
 	case *storeSqlite != "":
 		if store, err = storage.NewSqlite(*storeSqlite); err != nil {
-			logger.Error.Fatal(err)
+			fatal(err)
 		}
 	default:
 		store, _ = storage.NewMemory()
@@ -79,25 +301,35 @@ func main() {
 		defaultconfig.Domains = append(defaultconfig.Domains, domain.Domain{URL: "http://www.moko.cc/"})
 		store.SaveConfig(defaultconfig)
 	*/
+	if *cookieFile != "" {
+		if err := importCookies(store, *cookieFile); err != nil {
+			fatalf("Error importing cookies: %s", err)
+		}
+	}
+
 	if *printConf {
 		c := new(config.Config)
 		if err := store.GetConfig(c); err != nil {
-			logger.Error.Fatalf("Error getting config: %s", err)
+			fatalf("Error getting config: %s", err)
 		}
 		Print_obj(c, "")
 		return
 	}
 
+	if *validate {
+		exit(validateConfig(store))
+	}
+
 	// Set up queue backend
 	var q queue.Queue
 	switch {
 	case *queueBeanstalk != "":
 		if q, err = queue.NewBeanstalk(*queueBeanstalk); err != nil {
-			logger.Error.Fatal(err)
+			fatal(err)
 		}
 	case *queueMongo != "":
 		//if q, err = queue.NewMongo(*queueMongo, *queueMongoShard); err != nil {
-		//	logger.Error.Fatal(err)
+		//	fatal(err)
 		//}
 	default:
 		q = queue.NewMemory(1024)
@@ -105,9 +337,12 @@ func main() {
 
 	//http监控
 	http.Handle("/rss/", feed.New(store))
+	http.HandleFunc("/bandwidth", bandwidthHandler(store))
+	http.HandleFunc("/delay", delayHandler)
+	http.HandleFunc("/quarantine", quarantineHandler(store))
 	go func() {
 		if err := http.ListenAndServe(*listen, nil); err != nil {
-			logger.Error.Fatal(err)
+			fatal(err)
 		}
 	}()
 
@@ -118,7 +353,7 @@ func main() {
 	//初始化调度
 	sch, err := scheduler.New(q, store)
 	if err != nil {
-		logger.Error.Fatal(err)
+		fatal(err)
 	}
 
 	if *once {
@@ -130,16 +365,52 @@ func main() {
 	for sch.Next() {
 		//从调度中，获取要下载的地址
 		if err := sch.Cur(d, p); err != nil {
-			logger.Error.Fatal(err)
+			fatal(err)
 		}
 		//logger.Debug.Printf("Processing: %s", p.URL)
-		/*
-			if err := d.CanDownload(p); err != nil {
-				logger.Warn.Printf("Cannot download %s: %s", p.URL, err)
+		if err := d.CanDownload(p); err != nil {
+			if delay, ok := d.RetryDelay(p, sch.Attempt(), err); ok {
+				logger.Debug.Printf("Cannot download %s yet (%s), retrying in %s", p.URL, err, delay)
+				sch.Retry(delay)
 				continue
 			}
-		*/
-		switch err := p.Download(); err {
+			logger.Warn.Printf("Cannot download %s: %s", p.URL, err)
+			continue
+		}
+		f, err := d.Fetcher()
+		if err != nil {
+			fatal(err)
+		}
+		err = p.DownloadWith(f)
+		if err == nil && d.Login.IsLoggedOut(p.GetBody()) {
+			logger.Warn.Printf("Logged out of %s, logging in again", d.DisplayName())
+			if err = d.LogIn(); err != nil {
+				logger.Error.Printf("Error logging in to %s again: %s", d.DisplayName(), err)
+				err = login.ErrLoggedOut
+			} else {
+				// Don't let the logged out copy make this request conditional
+				p.ETag, p.LastModifiedHeader = "", ""
+				err = p.DownloadWith(f)
+			}
+		}
+		d.Observe(p.Response())
+		if delay, ok := d.RetryDelay(p, sch.Attempt(), err); ok {
+			// Not recorded, the stored page only learns of the last attempt
+			logger.Debug.Printf("%s attempt %d failed (%s), retrying in %s", p.URL, sch.Attempt(), err, delay)
+			sch.Retry(delay)
+			continue
+		}
+		d.Reschedule(p)
+		if resp := p.Response(); resp != nil {
+			logger.Trace.Printf("%s %d %s %d bytes in %s (connect %s, first byte %s)", p.URL, resp.StatusCode, resp.ContentType, resp.Size, resp.Timing.Total, resp.Timing.Connect, resp.Timing.StartTransfer)
+			if resp.EffectiveURL != p.URL {
+				logger.Debug.Printf("%s redirected to %s", p.URL, resp.EffectiveURL)
+			}
+			if sch.Attempt() > 1 {
+				logger.Debug.Printf("%s took %d attempts", p.URL, sch.Attempt())
+			}
+		}
+		switch err {
 		case nil:
 			if err := p.SetTitle(); err != nil {
 				logger.Warn.Printf("Error setting title: %s", err)
@@ -150,22 +421,58 @@ func main() {
 			//sch.Update(p) //更新采集时间
 			//continue
 			sch.Update(p, "update")
+		case page.ErrEmptyBody:
+			logger.Warn.Printf("Empty body: %s", p.URL)
+			sch.Update(p, "update")
+			continue
+		case download.ErrTooLarge, download.ErrContentType:
+			// Recorded with the reason, but not parsed
+			logger.Warn.Printf("Skipped %s (%s): %s", p.URL, p.ContentType, err)
+			sch.Update(p, "update")
+			continue
+		case login.ErrLoggedOut:
+			// Not the page's fault, it keeps its retries and stored copy
+			logger.Warn.Printf("Not saving %s, served logged out", p.URL)
+			continue
+		case warc.ErrNotArchived:
+			// Replaying, never go to the network for what is missing
+			logger.Warn.Printf("Not archived: %s", p.URL)
+			continue
 		default:
-			//logger.Error.Printf("Error downloading: %s", err)
+			if _, ok := err.(*page.StatusError); ok {
+				// The server answered, record the status but don't look for
+				// links in an error page
+				logger.Warn.Print(err)
+				sch.Update(p, "update")
+				continue
+			}
+			// Retries are used up by now, record the failure
+			logger.Error.Printf("Error downloading %s (%d failures in a row): %s", p.URL, p.Failures, err)
+			sch.Update(p, "update")
 			continue
 		}
 
+		if !d.InScope(p.URL) {
+			// One hop outside the domain, not crawled any further
+			continue
+		}
 		links, err := p.Links()
 		if err != nil {
-			logger.Error.Fatal(err)
+			logger.Error.Printf("Error reading links of %s: %s", p.URL, err)
+			continue
 		}
 		for i := range links {
+			// Variants of a URL are one page to the queue and storage
+			links[i] = d.Canonical(links[i])
+			if !d.Follows(links[i]) {
+				continue
+			}
 			l := page.New(links[i])
-			/*
-				if err := d.CanDownload(l); err != nil {
-					continue
-				}
-			*/
+			l.Depth = sch.Depth() + 1
+			// robots.txt is up to CanDownload once it is dequeued
+			if err := d.CanQueue(l); err != nil {
+				continue
+			}
 			//logger.Warn.Printf("Link: %s", links[i])
 			//是否在数据库中
 			if store.GetPage(links[i], new(page.Page)) != storage.ErrNotFound {
@@ -173,7 +480,7 @@ func main() {
 				continue
 			}
 			//如果不在队列,则添加到队列
-			if err := sch.Add(links[i]); err != nil {
+			if err := sch.AddTo(d, links[i], sch.Depth()+1); err != nil {
 				//logger.Warn.Printf("Error adding %s: %s", links[i], err)
 				continue
 			}
@@ -188,6 +495,6 @@ func main() {
 	}
 
 	if err := sch.Err(); err != nil {
-		logger.Error.Fatal(err)
+		fatal(err)
 	}
 }
@@ -2,29 +2,64 @@ package page
 
 import (
 	"bytes"
+	"canon"
+	"code.google.com/p/go.net/html/charset"
+	"code.google.com/p/go.text/encoding"
+	"code.google.com/p/go.text/transform"
 	"download"
 	"errors"
+	"fmt"
 	"github.com/PuerkitoBio/goquery"
 	"hash/crc32"
-	_ "io/ioutil"
+	"io/ioutil"
 	_ "logger"
+	"net/http"
 	"net/url"
-	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 type Page struct {
-	URL           string
-	Title         string
-	Checksum      uint32
-	FirstDownload time.Time
-	LastDownload  time.Time
-	LastModified  time.Time
-	url           *url.URL
-	data          []byte
+	URL                string
+	Title              string
+	Checksum           uint32
+	FirstDownload      time.Time
+	LastDownload       time.Time
+	LastModified       time.Time
+	StatusCode         int           // Status of the last download
+	ContentType        string        // Content-Type of the last download
+	EffectiveURL       string        // URL the last download ended up at after redirects
+	ETag               string        // ETag header of the last full download
+	LastModifiedHeader string        // Last-Modified header of the last full download
+	Size               int64         // Body size of the last full download
+	Charset            string        // Character set the last full download was decoded from
+	Failures           int           // Failed downloads in a row, reset by a successful one
+	Error              string        // Why the last download failed, empty if it did not
+	NextDownload       time.Time     // When the page is due again, see domain.Domain.Reschedule
+	Interval           time.Duration // Time between downloads the change history suggests
+	Changes            int           // Downloads after the first that found the content changed
+	Depth              int           // Links between the page and a start point, as queued
+	url                *url.URL
+	resp               *download.Response
+	raw                []byte // Body as downloaded
+	data               []byte // Body converted to UTF-8
 }
 
-var ErrNotModified = errors.New("Not modified")
+// StatusError is returned by Download when the server answers with anything
+// other than a 2xx status.
+type StatusError struct {
+	URL        string
+	StatusCode int
+}
+
+var (
+	ErrNotModified = errors.New("Not modified")
+	ErrEmptyBody   = errors.New("Empty body")
+)
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s returned HTTP %d", e.URL, e.StatusCode)
+}
 
 func New(rawurl string) (p *Page) {
 	p = &Page{
@@ -35,35 +70,107 @@ func New(rawurl string) (p *Page) {
 func (p *Page) GetBody() string {
 	return string(p.data)
 }
+
+// GetChecksum sums the body as downloaded, so it does not change with the
+// charset detection.
 func (p *Page) GetChecksum() uint32 {
-	return crc32.ChecksumIEEE(p.data)
+	return crc32.ChecksumIEEE(p.raw)
 }
 
-func (p *Page) Domain() string {
-	d := p.GetURL().Host
-	if strings.HasPrefix(d, "www.") {
-		d = d[4:]
-	}
-	return d
+// Raw returns the body as downloaded, before conversion to UTF-8.
+func (p *Page) Raw() []byte {
+	return p.raw
+}
+
+// Domain returns the registrable domain of the page, the same name
+// domain.FromURL gives, or an error if URL has no valid host.
+func (p *Page) Domain() (name string, err error) {
+	return canon.Registrable(p.URL)
 }
 
+// Response returns the response of the last download, nil if the last
+// download never got an answer from the server.
+func (p *Page) Response() *download.Response {
+	return p.resp
+}
+
+// Download fetches the page. Transport errors are returned as-is, non-2xx
+// responses as a *StatusError and an empty 2xx body as ErrEmptyBody. Whenever
+// the server answered, StatusCode and friends are updated so the result can
+// be stored.
+//
+// If an earlier download left an ETag or Last-Modified value the request is
+// made conditional; a 304 answer returns ErrNotModified without a body.
+//
+// A body over the domain's size limit or of a type not on its allowlist
+// returns download.ErrTooLarge or download.ErrContentType. Nothing is kept to
+// parse, the reason is left in Error.
 func (p *Page) Download() (err error) {
+	return p.DownloadWith(download.DefaultFetcher)
+}
+
+// DownloadWith is Download using f, usually the Fetcher of the page's domain.
+func (p *Page) DownloadWith(f download.Fetcher) (err error) {
 	now := time.Now()
-	//resp, err := download.Get(p.URL)
-	//if err != nil {
-	//	return
-	//}
-	//defer resp.Body.Close()
-
-	//contentType := resp.Header.Get("Content-Type")
-	//logger.Debug.Printf("%s Content-Type: %s", p.URL, contentType)
-
-	//if p.data, err = ioutil.ReadAll(resp.Body); err != nil {
-	//	return
-	//}
-	p.data, err = download.Get(p.URL)
-	//logger.Error.Printf("url: %s , Title: %s ", p.URL, p.Title)
+	req := download.NewRequest(p.URL)
+	if p.ETag != "" {
+		req.Header.Set("If-None-Match", p.ETag)
+	}
+	if p.LastModifiedHeader != "" {
+		req.Header.Set("If-Modified-Since", p.LastModifiedHeader)
+	}
+	// Only a missing or non-2xx answer counts as a failure, a skipped body
+	// keeps its reason in Error
+	defer func() {
+		_, status := err.(*StatusError)
+		switch {
+		case status || (err != nil && p.resp == nil):
+			p.Failures++
+			p.Error = err.Error()
+		case err == download.ErrTooLarge || err == download.ErrContentType:
+			p.Failures = 0
+			p.Error = err.Error()
+		default:
+			p.Failures, p.Error = 0, ""
+		}
+	}()
+	p.raw, p.data = nil, nil
+	p.resp, err = f.Fetch(req)
+	if p.resp == nil {
+		return
+	}
+	defer p.resp.Body.Close()
+
+	p.StatusCode = p.resp.StatusCode
+	p.ContentType = p.resp.ContentType
+	p.EffectiveURL = p.resp.EffectiveURL
 	p.LastDownload = now
+	if err != nil {
+		// Cut off or not HTML, nothing to parse
+		return
+	}
+	if p.StatusCode == http.StatusNotModified {
+		download.Stats.Add("not_modified", 1)
+		download.Stats.Add("bytes_saved", p.Size)
+		return ErrNotModified
+	}
+	if !p.resp.OK() {
+		return &StatusError{URL: p.URL, StatusCode: p.StatusCode}
+	}
+
+	if p.raw, err = ioutil.ReadAll(p.resp.Body); err != nil {
+		return
+	}
+	if len(p.raw) == 0 {
+		return ErrEmptyBody
+	}
+	if err = p.decode(); err != nil {
+		return
+	}
+	p.ETag = p.resp.Header.Get("ETag")
+	p.LastModifiedHeader = p.resp.Header.Get("Last-Modified")
+	p.Size = p.resp.Size
+
 	if p.FirstDownload.IsZero() || p.FirstDownload.UnixNano() < 0 {
 		p.FirstDownload = now
 	}
@@ -77,42 +184,55 @@ func (p *Page) Download() (err error) {
 	return ErrNotModified
 }
 
-func (p *Page) GetURL() (u *url.URL) {
-	if p.url != nil {
-		return p.url
+// decode converts the raw body to UTF-8. The charset comes from a BOM, the
+// Content-Type header or a <meta> tag, in that order; a body without any of
+// them is taken as UTF-8 if it is valid UTF-8, windows-1252 otherwise.
+func (p *Page) decode() (err error) {
+	e, name, certain := charset.DetermineEncoding(p.raw, p.ContentType)
+	if !certain && utf8.Valid(p.raw) {
+		e, name = encoding.Nop, "utf-8"
 	}
-	u, _ = url.Parse(p.URL)
-	if u.Path == "" {
-		u.Path = "/"
+	p.Charset = name
+	if e == encoding.Nop {
+		p.data = p.raw
+		return
 	}
+	p.data, err = ioutil.ReadAll(transform.NewReader(bytes.NewReader(p.raw), e.NewDecoder()))
 	return
 }
 
-func cmpurl(url1 string, url2 string) (re bool, err error) {
-	var u1, u2 *url.URL
-	//var err error
-	re = false
-	u1, err = url.Parse(url1)
-	if err != nil {
-		return
+// GetURL returns URL parsed, or an error if it does not parse.
+func (p *Page) GetURL() (u *url.URL, err error) {
+	if p.url != nil {
+		return p.url, nil
 	}
-	u2, err = url.Parse(url2)
-	if err != nil {
+	if u, err = url.Parse(p.URL); err != nil {
 		return
 	}
-	if u1.Host == u2.Host {
-		re = true
+	if u.Path == "" {
+		u.Path = "/"
 	}
 	return
 }
 
+// Links returns the http and https links of the page, resolved against the
+// URL it ended up at. Which of them to follow is up to the domain's scope.
+// A page whose URL does not parse has none, and returns the parse error.
 func (p *Page) Links() (links []string, err error) {
+	// Relative links are relative to wherever redirects took us
+	base, err := p.GetURL()
+	if err != nil {
+		return
+	}
 	d, err := goquery.NewDocumentFromReader(bytes.NewReader(p.data))
 	if err != nil {
 		return
 	}
-
-	base := p.GetURL()
+	if p.EffectiveURL != "" && p.EffectiveURL != p.URL {
+		if u, err := url.Parse(p.EffectiveURL); err == nil {
+			base = u
+		}
+	}
 	sel := d.Find("a[href]")
 	links = make([]string, 0, sel.Length())
 	sel.Each(func(i int, s *goquery.Selection) {
@@ -125,11 +245,9 @@ func (p *Page) Links() (links []string, err error) {
 		if err != nil {
 			return
 		}
-		//是否是域名的下得链接
-		link := base.ResolveReference(ref).String()
-		//logger.Error.Printf("domain: %s , link: %s ", p.URL, link)
-		if re, _ := cmpurl(p.URL, link); re == true {
-			links = append(links, link)
+		link := base.ResolveReference(ref)
+		if link.Scheme == "http" || link.Scheme == "https" {
+			links = append(links, link.String())
 		}
 	})
 	return
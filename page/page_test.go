@@ -1,8 +1,12 @@
 package page
 
 import (
+	"bytes"
+	"download"
 	"github.com/300brand/spider/samplesite"
 	"launchpad.net/gocheck"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 )
 
@@ -18,3 +22,94 @@ func (s *PageSuite) TestRobotsTxt(c *gocheck.C) {
 	c.Assert(p.SetTitle(), gocheck.IsNil)
 	c.Assert(p.Title, gocheck.Equals, "Index")
 }
+
+func (s *PageSuite) TestConditionalGet(c *gocheck.C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", "Thu, 05 Jun 2014 16:21:15 GMT")
+		w.Write([]byte("<title>Cached</title>"))
+	}))
+	defer ts.Close()
+
+	p := New(ts.URL)
+	c.Assert(p.Download(), gocheck.IsNil)
+	c.Assert(p.ETag, gocheck.Equals, `"v1"`)
+	c.Assert(p.LastModifiedHeader, gocheck.Equals, "Thu, 05 Jun 2014 16:21:15 GMT")
+	c.Assert(p.Size, gocheck.Equals, int64(len("<title>Cached</title>")))
+
+	c.Assert(p.Download(), gocheck.Equals, ErrNotModified)
+	c.Assert(p.StatusCode, gocheck.Equals, http.StatusNotModified)
+	c.Assert(p.Response().Size, gocheck.Equals, int64(0))
+}
+
+func (s *PageSuite) TestSkippedBody(c *gocheck.C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Write([]byte("<a href=\"/not-a-link\">"))
+	}))
+	defer ts.Close()
+
+	f, err := download.New("", download.Options{ContentTypes: download.DefaultContentTypes})
+	c.Assert(err, gocheck.IsNil)
+	p := New(ts.URL)
+	c.Assert(p.DownloadWith(f), gocheck.Equals, download.ErrContentType)
+	c.Assert(p.StatusCode, gocheck.Equals, http.StatusOK)
+	c.Assert(p.ContentType, gocheck.Equals, "video/mp4")
+	c.Assert(p.Error, gocheck.Equals, download.ErrContentType.Error())
+	c.Assert(p.Failures, gocheck.Equals, 0)
+	links, err := p.Links()
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(links, gocheck.HasLen, 0)
+}
+
+func (s *PageSuite) TestCharset(c *gocheck.C) {
+	// "<title>中文</title>" in GBK
+	gbk := []byte("<title>\xd6\xd0\xce\xc4</title>")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/header":
+			w.Header().Set("Content-Type", "text/html; charset=gb2312")
+			w.Write(gbk)
+		case "/meta":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<meta charset="gbk">`))
+			w.Write(gbk)
+		default:
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<title>中文</title>"))
+		}
+	}))
+	defer ts.Close()
+
+	for _, path := range []string{"/header", "/meta", "/utf8"} {
+		p := New(ts.URL + path)
+		c.Assert(p.Download(), gocheck.IsNil)
+		c.Assert(p.SetTitle(), gocheck.IsNil)
+		c.Assert(p.Title, gocheck.Equals, "中文", gocheck.Commentf(path))
+		if path == "/utf8" {
+			c.Assert(p.Charset, gocheck.Equals, "utf-8")
+		} else {
+			c.Assert(p.Charset, gocheck.Equals, "gbk")
+			c.Assert(bytes.HasSuffix(p.Raw(), gbk), gocheck.Equals, true)
+		}
+	}
+}
+
+func (s *PageSuite) TestMalformedURL(c *gocheck.C) {
+	p := New("http://[::1")
+	_, err := p.GetURL()
+	c.Check(err, gocheck.NotNil)
+	links, err := p.Links()
+	c.Check(err, gocheck.NotNil)
+	c.Check(links, gocheck.HasLen, 0)
+	_, err = p.Domain()
+	c.Check(err, gocheck.NotNil)
+
+	u, err := New("http://www.moko.cc").GetURL()
+	c.Assert(err, gocheck.IsNil)
+	c.Check(u.Path, gocheck.Equals, "/")
+}
@@ -0,0 +1,97 @@
+package scheduler
+
+import (
+	"domain"
+	"errors"
+	"fmt"
+	"logger"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrBudget  = errors.New("Crawl budget used up")
+	ErrTooDeep = errors.New("Link depth over the limit")
+)
+
+// pass tracks the budget of one crawl pass over a domain, from restart until
+// its queue runs empty.
+type pass struct {
+	start time.Time
+	pages int    // Handed out by Next
+	over  string // Why the budget ran out, empty while it lasts
+	done  bool   // Queue ran empty, waiting for the next scheduled pass
+}
+
+// startPass resets the budget of d.
+func (s *Scheduler) startPass(d *domain.Domain) {
+	s.passMu.Lock()
+	defer s.passMu.Unlock()
+	s.passes[d.Domain()] = &pass{start: s.clock.Now()}
+}
+
+// finish marks the pass over d as done, until startPass begins the next one.
+func (s *Scheduler) finish(d *domain.Domain) {
+	s.passMu.Lock()
+	defer s.passMu.Unlock()
+	if p, ok := s.passes[d.Domain()]; ok {
+		p.done = true
+	} else {
+		s.passes[d.Domain()] = &pass{done: true}
+	}
+}
+
+// finished reports whether d waits for its next scheduled pass.
+func (s *Scheduler) finished(d *domain.Domain) bool {
+	s.passMu.Lock()
+	defer s.passMu.Unlock()
+	p, ok := s.passes[d.Domain()]
+	return ok && p.done
+}
+
+// budget returns ErrBudget once d used up its pages or time for this pass.
+func (s *Scheduler) budget(d *domain.Domain) error {
+	s.passMu.Lock()
+	defer s.passMu.Unlock()
+	p, ok := s.passes[d.Domain()]
+	if !ok {
+		return nil
+	}
+	if p.over == "" {
+		switch {
+		case d.MaxPages > 0 && p.pages >= d.MaxPages:
+			p.over = fmt.Sprintf("%d pages", p.pages)
+		case d.MaxDuration > 0 && s.clock.Now().Sub(p.start) > d.MaxDuration:
+			p.over = d.MaxDuration.String()
+		default:
+			return nil
+		}
+		logger.Warn.Printf("Budget of %s used up after %s, queueing no more pages this pass", d.DisplayName(), p.over)
+	}
+	return ErrBudget
+}
+
+// count adds a page handed out for d to its pass.
+func (s *Scheduler) count(d *domain.Domain) {
+	s.passMu.Lock()
+	defer s.passMu.Unlock()
+	if p, ok := s.passes[d.Domain()]; ok {
+		p.pages++
+	}
+}
+
+// Queued URLs carry their depth in front, "2 http://..."; plain URLs queued
+// by older versions are start points.
+func encodeItem(url string, depth int) string {
+	return strconv.Itoa(depth) + " " + url
+}
+
+func decodeItem(v string) (url string, depth int) {
+	if i := strings.IndexByte(v, ' '); i > 0 {
+		if d, err := strconv.Atoi(v[:i]); err == nil {
+			return v[i+1:], d
+		}
+	}
+	return v, 0
+}
@@ -0,0 +1,19 @@
+package scheduler
+
+import (
+	"time"
+)
+
+// Clock tells the scheduler the time and wakes it up. Schedulers use the one
+// defaultClock holds when they are created; tests swap in a fake one.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+var defaultClock Clock = realClock{}
@@ -0,0 +1,50 @@
+package scheduler
+
+import (
+	"domain"
+	"time"
+)
+
+// retry is a page queued again after a failed download.
+type retry struct {
+	url     string
+	depth   int
+	attempt int
+	at      time.Time // Not handed out before
+}
+
+// Attempt returns which attempt at downloading the current page this is, 1
+// unless Retry queued it again.
+func (s *Scheduler) Attempt() int {
+	return s.curAttempt
+}
+
+// Retry queues the current page again, to be handed out by Next no sooner
+// than delay from now, see domain.Domain.RetryDelay. Its domain goes on
+// with other pages in the meantime.
+func (s *Scheduler) Retry(delay time.Duration) {
+	name := s.curDomain.Domain()
+	s.retries[name] = append(s.retries[name], retry{
+		url:     s.curUrl,
+		depth:   s.curDepth,
+		attempt: s.curAttempt + 1,
+		at:      s.clock.Now().Add(delay),
+	})
+}
+
+// dueRetry takes the retry of d that was due first, if any is due.
+func (s *Scheduler) dueRetry(d *domain.Domain) (r retry, ok bool) {
+	retries := s.retries[d.Domain()]
+	now, due := s.clock.Now(), -1
+	for i := range retries {
+		if !retries[i].at.After(now) && (due < 0 || retries[i].at.Before(retries[due].at)) {
+			due = i
+		}
+	}
+	if due < 0 {
+		return
+	}
+	r = retries[due]
+	s.retries[d.Domain()] = append(retries[:due], retries[due+1:]...)
+	return r, true
+}
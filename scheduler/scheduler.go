@@ -5,9 +5,12 @@ import (
 	"domain"
 	"errors"
 	"logger"
+	"net/http"
 	"page"
 	"queue"
+	"sitemap"
 	"storage"
+	"sync"
 	"time"
 )
 
@@ -15,11 +18,18 @@ type Scheduler struct {
 	config       *config.Config
 	curDomain    *domain.Domain
 	curUrl       string
+	curDepth     int
+	curAttempt   int
 	defaultQueue queue.Queue
 	err          error
 	notify       chan *domain.Domain
 	once         bool
 	queues       map[string]queue.Queue
+	domains      map[string]*domain.Domain
+	passes       map[string]*pass
+	passMu       sync.Mutex
+	retries      map[string][]retry // Only touched by the crawl loop
+	clock        Clock
 	shutdown     chan bool
 	store        storage.Storage
 }
@@ -28,11 +38,15 @@ var (
 	ErrQueueNotFound = errors.New("Queue not found")
 )
 
+// Most due pages a pass begins with, the rest wait for the next one
+const dueBatch = 512
+
 func New(q queue.Queue, store storage.Storage) (s *Scheduler, err error) {
 	s = &Scheduler{
 		config:       new(config.Config),
 		defaultQueue: q,
 		store:        store,
+		clock:        defaultClock,
 	}
 	//加载配置
 	if err = store.GetConfig(s.config); err != nil {
@@ -40,6 +54,9 @@ func New(q queue.Queue, store storage.Storage) (s *Scheduler, err error) {
 	}
 	//初始化队列
 	s.queues = make(map[string]queue.Queue, len(s.config.Domains))
+	s.domains = make(map[string]*domain.Domain, len(s.config.Domains))
+	s.passes = make(map[string]*pass, len(s.config.Domains))
+	s.retries = make(map[string][]retry, len(s.config.Domains))
 	//线程通道
 	s.notify = make(chan *domain.Domain, len(s.config.Domains))
 	//关闭信号
@@ -49,13 +66,85 @@ func New(q queue.Queue, store storage.Storage) (s *Scheduler, err error) {
 	return
 }
 
+// Add queues url in canonical form as a start point, see Canonical. It
+// returns ErrBudget once the budget of its domain ran out for this pass.
 func (s *Scheduler) Add(url string) (err error) {
 	//找到对应url是否在的队列
-	q, ok := s.queues[domain.FromURL(url)]
+	name, err := domain.FromURL(url)
+	if err != nil {
+		return
+	}
+	q, ok := s.queues[name]
 	if !ok {
 		return ErrQueueNotFound
 	}
-	return q.Enqueue(url)
+	if err = s.budget(s.domains[name]); err != nil {
+		return
+	}
+	return q.Enqueue(encodeItem(s.Canonical(url), 0))
+}
+
+// AddTo queues url for d, whatever domain url belongs to. Links are queued
+// for the domain they were found on, whose scope allowed them.
+//
+// depth is the number of links between url and a start point, usually one
+// more than Depth. Deeper links than d.MaxDepth return ErrTooDeep.
+func (s *Scheduler) AddTo(d *domain.Domain, url string, depth int) (err error) {
+	q, ok := s.queues[d.Domain()]
+	if !ok {
+		return ErrQueueNotFound
+	}
+	if d.MaxDepth > 0 && depth > d.MaxDepth {
+		return ErrTooDeep
+	}
+	if _, err = domain.FromURL(url); err != nil {
+		return
+	}
+	if err = s.budget(d); err != nil {
+		return
+	}
+	url = d.Canonical(url)
+	if err = d.CheckTrap(url); err != nil {
+		s.quarantine(d, err)
+		return
+	}
+	return q.Enqueue(encodeItem(url, depth))
+}
+
+// quarantine stores URLs CheckTrap turned down for review.
+func (s *Scheduler) quarantine(d *domain.Domain, err error) {
+	trap, ok := err.(*domain.TrapError)
+	if !ok {
+		return
+	}
+	logger.Warn.Printf("Quarantining %s: %s", trap.URL, trap.Reason)
+	q := &storage.Quarantined{
+		URL:    trap.URL,
+		Domain: d.Domain(),
+		Reason: trap.Reason,
+		Time:   s.clock.Now(),
+	}
+	if err := s.store.Quarantine(q); err != nil {
+		logger.Error.Printf("Error quarantining %s: %s", trap.URL, err)
+	}
+}
+
+// Depth returns the link depth of the current URL, 0 for start points.
+func (s *Scheduler) Depth() int {
+	return s.curDepth
+}
+
+// Canonical returns url in canonical form under the rules of its domain, as
+// it should be queued and looked up in storage.
+func (s *Scheduler) Canonical(url string) string {
+	name, err := domain.FromURL(url)
+	if err != nil {
+		return url
+	}
+	if d, ok := s.domains[name]; ok {
+		return d.Canonical(url)
+	}
+	return url
 }
 
 //获取当前光标指向的 ？？？？
@@ -64,15 +153,13 @@ func (s *Scheduler) Cur(d *domain.Domain, p *page.Page) (err error) {
 	//获取当前地址在数据库中得信息
 	switch err := s.store.GetPage(s.curUrl, p); err {
 	case nil: //存在
-		return nil
 	case storage.ErrNotFound: //不存在
 		*p = page.Page{URL: s.curUrl}
-		return nil
 	default: //报错
 		return err
 	}
-
-	return
+	p.Depth = s.curDepth
+	return nil
 }
 
 func (s *Scheduler) Err() error {
@@ -86,6 +173,7 @@ func (s *Scheduler) Next() bool {
 	}
 
 	var d *domain.Domain
+wait:
 	for {
 		// Wait for the next domain to surface
 		select {
@@ -94,6 +182,12 @@ func (s *Scheduler) Next() bool {
 			return false
 		}
 
+		if r, ok := s.dueRetry(d); ok {
+			s.curDomain = d
+			s.curUrl, s.curDepth, s.curAttempt = r.url, r.depth, r.attempt
+			return true
+		}
+
 		var url string
 		var err error
 		// p := new(page.Page)
@@ -101,13 +195,25 @@ func (s *Scheduler) Next() bool {
 			url, err = s.queues[d.Domain()].Dequeue()
 			//logger.Info.Printf("Got %s from queue", url)
 			if err == queue.ErrEmpty {
+				if len(s.retries[d.Domain()]) > 0 {
+					// Not done until the retries are
+					continue wait
+				}
 				if s.once {
 					s.Stop()
 					return false
 				}
-				// When the queue is empty, start over from the top
-				logger.Warn.Print("restarting")
-				s.restart(d)
+				// Scheduled domains wait for their next pass, others start
+				// over from the top
+				if d.Schedule != "" {
+					logger.Info.Printf("Pass over %s done, next one at %s", d.DisplayName(), d.NextPass(s.clock.Now()))
+					s.finish(d)
+					continue wait
+				}
+				if s.restart(d) == 0 {
+					// Nothing due yet
+					continue wait
+				}
 				continue
 			}
 
@@ -116,6 +222,11 @@ func (s *Scheduler) Next() bool {
 				return false
 			}
 
+			// What is left of the pass once the budget ran out is dropped
+			if s.budget(d) != nil {
+				continue
+			}
+			s.count(d)
 			break
 
 			// if d.IsStartPoint(url) {
@@ -142,10 +253,10 @@ func (s *Scheduler) Next() bool {
 		}
 
 		s.curDomain = d
-		s.curUrl = url
+		s.curUrl, s.curDepth = decodeItem(url)
+		s.curAttempt = 1
 		return true
 	}
-	return false
 }
 
 func (s *Scheduler) Once() {
@@ -156,7 +267,15 @@ func (s *Scheduler) Once() {
 func (s *Scheduler) Start() {
 	for i := range s.config.Domains {
 		d := &s.config.Domains[i]
+		d.CanonicalStartPoints()
+		s.loadCookies(d)
+		s.loadDelay(d)
+		// Cur hands out copies of d, they should all share one Fetcher
+		if _, err := d.Fetcher(); err != nil {
+			logger.Error.Printf("Error creating fetcher for %s: %s", d.Domain(), err)
+		}
 		s.queues[d.Domain()] = s.defaultQueue.New(d.Domain())
+		s.domains[d.Domain()] = d
 		go s.notifier(d)
 	}
 }
@@ -173,28 +292,218 @@ func (s *Scheduler) Update(p *page.Page, event string) (err error) {
 	} else if event == "update" {
 		err = s.store.UpdatePage(p)
 	}
+	if s.curDomain != nil {
+		s.saveCookies(s.curDomain)
+		s.saveDelay(s.curDomain)
+	}
 	return err
 }
 
 //调度监控 消息线程
+//
+// Outside its Windows a domain's notifier pauses, and with a Schedule it
+// only restarts the domain's passes when they are due.
 func (s *Scheduler) notifier(d *domain.Domain) {
-	s.restart(d)
+	if err := d.LogIn(); err != nil {
+		logger.Error.Printf("Error logging in to %s: %s", d.Domain(), err)
+	}
+	s.seedSitemaps(d)
+	passes := s.nextPass(d)
+	if passes == nil {
+		s.restart(d)
+	} else {
+		s.finish(d)
+	}
 
+	every := d.SitemapEvery
+	if every <= 0 {
+		every = domain.DefaultSitemapEvery
+	}
+	sitemaps := s.clock.After(every)
+	paused := false
 	for {
+		var wake <-chan time.Time
+		crawl := false
+		now := s.clock.Now()
+		open := d.NextWindow(now)
+		switch {
+		case open.IsZero():
+			// Never open, the config says so
+		case open.After(now):
+			if !paused {
+				logger.Info.Printf("Pausing %s until %s", d.DisplayName(), open)
+				paused = true
+			}
+			wake = s.clock.After(open.Sub(now))
+		case s.finished(d):
+			// Until passes fires
+		default:
+			if paused {
+				logger.Info.Printf("Resuming %s", d.DisplayName())
+				paused = false
+			}
+			wake, crawl = s.clock.After(d.CrawlDelay()), true
+		}
 		select {
-		case <-time.After(d.Delay):
-			s.notify <- d
+		case <-wake:
+			if crawl && d.InWindow(s.clock.Now()) && !s.finished(d) {
+				s.notify <- d
+			}
+		case <-passes:
+			logger.Info.Printf("Starting a scheduled pass over %s", d.DisplayName())
+			s.restart(d)
+			passes = s.nextPass(d)
+		case <-sitemaps:
+			s.seedSitemaps(d)
+			sitemaps = s.clock.After(every)
 		case <-s.shutdown:
 			return
 		}
 	}
 }
 
-func (s *Scheduler) restart(d *domain.Domain) {
-	for i := range d.StartPoints {
-		s.Add(d.StartPoints[i])
+// nextPass fires when the next pass over d is due by its Schedule, nil if it
+// has none.
+func (s *Scheduler) nextPass(d *domain.Domain) <-chan time.Time {
+	now := s.clock.Now()
+	next := d.NextPass(now)
+	if next.IsZero() {
+		return nil
+	}
+	return s.clock.After(next.Sub(now))
+}
+
+// seedSitemaps queues the pages listed in d's sitemaps, except those that
+// did not change since they were last downloaded according to <lastmod>.
+func (s *Scheduler) seedSitemaps(d *domain.Domain) {
+	sitemaps := d.Sitemaps()
+	if len(sitemaps) == 0 {
+		return
+	}
+	f, err := d.FileFetcher(sitemap.MaxSize)
+	if err != nil {
+		logger.Error.Printf("Error creating fetcher for sitemaps of %s: %s", d.Domain(), err)
+		return
+	}
+	var queued, skipped int
+	for _, rawurl := range sitemaps {
+		urls, err := sitemap.Fetch(f, rawurl)
+		if err != nil {
+			logger.Warn.Printf("Error reading sitemap %s: %s", rawurl, err)
+		}
+		for _, u := range urls {
+			switch added, err := s.seed(u); {
+			case err == ErrQueueNotFound, err == ErrBudget:
+				// Another domain's page, or no room left this pass
+			case err != nil:
+				logger.Error.Printf("Error queueing %s: %s", u.Loc, err)
+			case added:
+				queued++
+			default:
+				skipped++
+			}
+		}
+	}
+	logger.Info.Printf("Queued %d pages from the sitemaps of %s, %d unchanged", queued, d.DisplayName(), skipped)
+}
+
+// seed queues the page at u unless it is stored with a LastModified after
+// u.LastMod.
+func (s *Scheduler) seed(u sitemap.URL) (added bool, err error) {
+	u.Loc = s.Canonical(u.Loc)
+	p := new(page.Page)
+	switch err = s.store.GetPage(u.Loc, p); err {
+	case nil:
+		if !u.LastMod.IsZero() && p.LastModified.After(u.LastMod) {
+			return
+		}
+		err = s.Add(u.Loc)
+	case storage.ErrNotFound:
+		if err = s.Add(u.Loc); err == nil {
+			err = s.store.SavePage(page.New(u.Loc))
+		}
+	}
+	return err == nil, err
+}
+
+// loadCookies restores the session saved for d by an earlier run.
+func (s *Scheduler) loadCookies(d *domain.Domain) {
+	var cookies []*http.Cookie
+	if err := s.store.GetCookies(d.Domain(), &cookies); err != nil {
+		logger.Error.Printf("Error loading cookies for %s: %s", d.Domain(), err)
+		return
+	}
+	d.Jar().Load(cookies)
+}
+
+// saveCookies stores d's cookies if they changed since they were last saved.
+func (s *Scheduler) saveCookies(d *domain.Domain) {
+	if !d.Jar().Dirty() {
+		return
 	}
-	if len(d.StartPoints) == 0 {
-		s.Add(d.GetURL().String())
+	if err := s.store.SaveCookies(d.Domain(), d.Jar().All()); err != nil {
+		logger.Error.Printf("Error saving cookies for %s: %s", d.Domain(), err)
 	}
 }
+
+// loadDelay restores the adaptive delay d had at the end of an earlier run.
+func (s *Scheduler) loadDelay(d *domain.Domain) {
+	if !d.AdaptiveDelay {
+		return
+	}
+	var delay time.Duration
+	if err := s.store.GetDelay(d.Domain(), &delay); err != nil {
+		logger.Error.Printf("Error loading delay of %s: %s", d.Domain(), err)
+		return
+	}
+	d.RestoreDelay(delay)
+}
+
+// saveDelay stores d's adaptive delay if it moved since it was last saved.
+func (s *Scheduler) saveDelay(d *domain.Domain) {
+	if !d.DelayChanged() {
+		return
+	}
+	if err := s.store.SaveDelay(d.Domain(), d.AdaptedDelay()); err != nil {
+		logger.Error.Printf("Error saving delay of %s: %s", d.Domain(), err)
+	}
+}
+
+// restart begins a pass over d: it queues the pages of d that are due
+// again, see domain.Domain.Reschedule, and the start points not crawled
+// yet. It returns how many pages it queued.
+func (s *Scheduler) restart(d *domain.Domain) (queued int) {
+	s.startPass(d)
+	starts := d.StartPoints
+	if len(starts) == 0 {
+		starts = []string{d.GetURL().String()}
+	}
+	for _, url := range starts {
+		if s.store.GetPage(s.Canonical(url), new(page.Page)) == storage.ErrNotFound && s.Add(url) == nil {
+			queued++
+		}
+	}
+
+	limit := dueBatch
+	if d.MaxPages > 0 && d.MaxPages < limit {
+		limit = d.MaxPages
+	}
+	var due []*page.Page
+	if err := s.store.GetDuePages(d.Domain(), s.clock.Now(), limit, &due); err != nil {
+		logger.Error.Printf("Error getting due pages of %s: %s", d.Domain(), err)
+	}
+	for _, p := range due {
+		// Pages keep the depth they were first queued at
+		depth := p.Depth
+		if d.IsStartPoint(p.URL) {
+			depth = 0
+		}
+		if s.AddTo(d, p.URL, depth) == nil {
+			queued++
+		}
+	}
+	if queued > 0 {
+		logger.Info.Printf("Pass over %s begins with %d pages", d.DisplayName(), queued)
+	}
+	return
+}
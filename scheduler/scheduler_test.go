@@ -8,7 +8,9 @@ import (
 	"queue"
 	"samplesite"
 	"storage"
+	"sync"
 	"testing"
+	"time"
 )
 
 type SchedulerSuite struct{}
@@ -17,52 +19,389 @@ var _ = gocheck.Suite(new(SchedulerSuite))
 
 func Test(t *testing.T) { gocheck.TestingT(t) }
 
-func (s *SchedulerSuite) TestCrawl(c *gocheck.C) {
-	storeBackend, err := storage.NewMemory()
+// crawl runs a single pass over the samplesite the way main does and returns
+// the URLs downloaded, with their depth.
+func crawl(c *gocheck.C, d domain.Domain) (crawled map[string]int) {
+	store, err := storage.NewMemory()
 	c.Assert(err, gocheck.IsNil)
-	store := storage.New(storeBackend)
 	defer store.Close()
 
-	store.SaveConfig(&config.Config{
-		Domains: []domain.Domain{
-			{
-				Name: "Samplesite",
-				URL:  samplesite.URL,
-			},
-		},
-	})
+	d.Name, d.URL = "Samplesite", samplesite.URL
+	store.SaveConfig(&config.Config{Domains: []domain.Domain{d}})
 
-	sch, err := New(queue.NewMemoryQueue(1024), store)
+	sch, err := New(queue.NewMemory(1024), store)
 	c.Assert(err, gocheck.IsNil)
 	sch.Once()
 	c.Logf("Scheduler ready, domains: %d", len(sch.config.Domains))
 
+	crawled = make(map[string]int)
 	var p page.Page
-	var d domain.Domain
 	for sch.Next() {
-		c.Check(sch.Cur(&d, &p), gocheck.IsNil)
-		c.Logf("Domain: %s Page: %s LastDownload: %s", d.URL, p.URL, p.LastDownload)
+		c.Assert(sch.Cur(&d, &p), gocheck.IsNil)
+		c.Logf("Domain: %s Page: %s Depth: %d", d.URL, p.URL, sch.Depth())
 
-		if !d.CanDownload(&p) {
-			c.Logf("\tShould not download, skipping!")
+		if err := d.CanDownload(&p); err != nil {
+			c.Logf("\tShould not download: %s", err)
 			continue
 		}
 
 		switch err := p.Download(); err {
 		case nil:
-			c.Assert(sch.Update(&p), gocheck.IsNil)
+			c.Assert(sch.Update(&p, "update"), gocheck.IsNil)
 		case page.ErrNotModified:
-			c.Assert(sch.Update(&p), gocheck.IsNil)
+			c.Assert(sch.Update(&p, "update"), gocheck.IsNil)
 			continue
 		default:
 			c.Fatal(err)
 		}
+		crawled[p.URL] = sch.Depth()
 
 		links, err := p.Links()
 		c.Check(err, gocheck.IsNil)
-		c.Logf("\tChecksum: %d Links: %+v", p.Checksum, links)
 		for i := range links {
-			sch.Add(links[i])
+			if store.GetPage(links[i], new(page.Page)) != storage.ErrNotFound {
+				continue
+			}
+			if sch.AddTo(&d, links[i], sch.Depth()+1) == nil {
+				l := page.New(links[i])
+				l.Depth = sch.Depth() + 1
+				sch.Update(l, "insert")
+			}
 		}
 	}
+	c.Assert(sch.Err(), gocheck.IsNil)
+	return
+}
+
+func (s *SchedulerSuite) TestCrawl(c *gocheck.C) {
+	crawled := crawl(c, domain.Domain{})
+	c.Check(crawled, gocheck.DeepEquals, map[string]int{
+		samplesite.URL + "/":         0,
+		samplesite.URL + "/article1": 1,
+		samplesite.URL + "/article2": 1,
+		samplesite.URL + "/article3": 1,
+		samplesite.URL + "/contact":  1,
+		samplesite.URL + "/latest":   1,
+	})
+}
+
+func (s *SchedulerSuite) TestBudget(c *gocheck.C) {
+	var d domain.Domain
+	d.MaxDepth = 0
+	d.MaxPages = 2
+	c.Check(crawl(c, d), gocheck.HasLen, 2)
+
+	d.MaxPages = 0
+	d.StartPoints = []string{samplesite.URL + "/latest"}
+	d.MaxDepth = 1
+	c.Check(crawl(c, d), gocheck.DeepEquals, map[string]int{
+		samplesite.URL + "/latest":   0,
+		samplesite.URL + "/":         1,
+		samplesite.URL + "/article1": 1,
+		samplesite.URL + "/article2": 1,
+		samplesite.URL + "/contact":  1,
+	})
+}
+
+func (s *SchedulerSuite) TestStartPointCanonical(c *gocheck.C) {
+	var d domain.Domain
+	// Start points are downloaded whatever Exclude says, in any form
+	d.StartPoints = []string{samplesite.URL + "/latest#top"}
+	d.Exclude = []string{"^/latest$"}
+	d.MaxDepth = 1
+	c.Check(crawl(c, d), gocheck.DeepEquals, map[string]int{
+		samplesite.URL + "/latest":   0,
+		samplesite.URL + "/":         1,
+		samplesite.URL + "/article1": 1,
+		samplesite.URL + "/article2": 1,
+		samplesite.URL + "/contact":  1,
+	})
+}
+
+func (s *SchedulerSuite) TestItem(c *gocheck.C) {
+	url, depth := decodeItem(encodeItem("http://www.moko.cc/a b", 3))
+	c.Check(url, gocheck.Equals, "http://www.moko.cc/a b")
+	c.Check(depth, gocheck.Equals, 3)
+	url, depth = decodeItem("http://www.moko.cc/")
+	c.Check(url, gocheck.Equals, "http://www.moko.cc/")
+	c.Check(depth, gocheck.Equals, 0)
+}
+
+// fakeClock only moves when told to.
+type fakeClock struct {
+	mutex   sync.Mutex
+	now     time.Time
+	waiters []fakeTimer
+}
+
+type fakeTimer struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) After(d time.Duration) <-chan time.Time {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	ch := make(chan time.Time, 1)
+	f.waiters = append(f.waiters, fakeTimer{f.now.Add(d), ch})
+	return ch
+}
+
+// Advance moves the clock on by d and fires the timers due by then.
+func (f *fakeClock) Advance(d time.Duration) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.now = f.now.Add(d)
+	pending := f.waiters[:0]
+	for _, w := range f.waiters {
+		if w.at.After(f.now) {
+			pending = append(pending, w)
+		} else {
+			w.ch <- f.now
+		}
+	}
+	f.waiters = pending
+}
+
+// wait blocks until a timer is due within d, that is until the notifiers
+// went back to sleep.
+func (f *fakeClock) wait(c *gocheck.C, d time.Duration) {
+	for i := 0; i < 500; i++ {
+		f.mutex.Lock()
+		for _, w := range f.waiters {
+			if !w.at.After(f.now.Add(d)) {
+				f.mutex.Unlock()
+				return
+			}
+		}
+		f.mutex.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Fatalf("No timer due within %s", d)
+}
+
+// schedule returns a Scheduler for the samplesite as d, running on a fake
+// clock set to start, with pages in storage.
+func schedule(c *gocheck.C, d domain.Domain, start time.Time, pages ...*page.Page) (sch *Scheduler, clock *fakeClock) {
+	store, err := storage.NewMemory()
+	c.Assert(err, gocheck.IsNil)
+	for _, p := range pages {
+		c.Assert(store.SavePage(p), gocheck.IsNil)
+	}
+	d.Name, d.URL = "Samplesite", samplesite.URL
+	d.Delay, d.SitemapEvery = time.Second, 30*24*time.Hour
+	c.Assert(store.SaveConfig(&config.Config{Domains: []domain.Domain{d}}), gocheck.IsNil)
+
+	clock = &fakeClock{now: start}
+	defaultClock = clock
+	defer func() { defaultClock = realClock{} }()
+	sch, err = New(queue.NewMemory(1024), store)
+	c.Assert(err, gocheck.IsNil)
+	return
+}
+
+func (s *SchedulerSuite) TestWindow(c *gocheck.C) {
+	var d domain.Domain
+	d.Windows = []domain.Window{{Days: []string{"mon"}, Start: "09:00", End: "10:00"}}
+	// A Saturday
+	sch, clock := schedule(c, d, time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC))
+	defer sch.Stop()
+
+	clock.wait(c, 45*time.Hour)
+	c.Check(sch.notify, gocheck.HasLen, 0)
+	clock.Advance(45 * time.Hour)
+	clock.wait(c, time.Second)
+	clock.Advance(time.Second)
+	select {
+	case <-sch.notify:
+	case <-time.After(5 * time.Second):
+		c.Fatal("Not resumed inside the window")
+	}
+
+	clock.wait(c, time.Second)
+	clock.Advance(time.Hour)
+	clock.wait(c, 7*24*time.Hour)
+	c.Check(sch.notify, gocheck.HasLen, 0)
+}
+
+func (s *SchedulerSuite) TestSchedule(c *gocheck.C) {
+	var d domain.Domain
+	d.Schedule = "0 3 * * *"
+	sch, clock := schedule(c, d, time.Date(2024, 6, 1, 2, 0, 0, 0, time.UTC))
+	q := sch.queues[sch.config.Domains[0].Domain()]
+
+	urls := make(chan string)
+	go func() {
+		for sch.Next() {
+			urls <- sch.curUrl
+		}
+		close(urls)
+	}()
+	next := func() string {
+		select {
+		case url := <-urls:
+			return url
+		case <-time.After(5 * time.Second):
+			c.Fatal("No pass began")
+		}
+		return ""
+	}
+
+	// Nothing until 3:00
+	clock.wait(c, time.Hour)
+	c.Check(q.Len(), gocheck.Equals, 0)
+	clock.Advance(time.Hour)
+	clock.wait(c, time.Second)
+	c.Check(q.Len(), gocheck.Equals, 1)
+	clock.Advance(time.Second)
+	c.Check(next(), gocheck.Equals, samplesite.URL+"/")
+
+	// The queue runs empty and the pass is over
+	clock.wait(c, time.Second)
+	clock.Advance(time.Second)
+	for i := 0; !sch.finished(&sch.config.Domains[0]); i++ {
+		c.Assert(i < 500, gocheck.Equals, true)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Until 3:00 the next day
+	clock.Advance(24*time.Hour - 2*time.Second)
+	clock.wait(c, time.Second)
+	clock.Advance(time.Second)
+	c.Check(next(), gocheck.Equals, samplesite.URL+"/")
+	sch.Stop()
+	for range urls {
+	}
+}
+
+func (s *SchedulerSuite) TestRecrawl(c *gocheck.C) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	sch, clock := schedule(c, domain.Domain{}, now,
+		&page.Page{URL: samplesite.URL + "/", NextDownload: now.Add(time.Hour)},
+		&page.Page{URL: samplesite.URL + "/article1", NextDownload: now.Add(-time.Minute), Depth: 1},
+		&page.Page{URL: samplesite.URL + "/article2", NextDownload: now.Add(-time.Hour), Depth: 1},
+		&page.Page{URL: samplesite.URL + "/latest", NextDownload: now.Add(time.Minute)},
+	)
+	defer sch.Stop()
+	clock.wait(c, time.Second)
+
+	// Due pages, the most overdue first, and not the start point
+	q := sch.queues[sch.config.Domains[0].Domain()]
+	var queued []string
+	for q.Len() > 0 {
+		item, err := q.Dequeue()
+		c.Assert(err, gocheck.IsNil)
+		queued = append(queued, item)
+	}
+	c.Check(queued, gocheck.DeepEquals, []string{
+		encodeItem(samplesite.URL+"/article2", 1),
+		encodeItem(samplesite.URL+"/article1", 1),
+	})
+	c.Check(sch.restart(&sch.config.Domains[0]), gocheck.Equals, 2)
+}
+
+func (s *SchedulerSuite) TestRecrawlDepth(c *gocheck.C) {
+	var d domain.Domain
+	d.MaxDepth = 2
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	sch, clock := schedule(c, d, now,
+		&page.Page{URL: samplesite.URL + "/", NextDownload: now.Add(time.Hour)},
+		&page.Page{URL: samplesite.URL + "/latest", NextDownload: now.Add(-time.Hour), Depth: 1},
+		&page.Page{URL: samplesite.URL + "/article1", NextDownload: now.Add(-time.Minute), Depth: 2},
+		&page.Page{URL: samplesite.URL + "/contact", NextDownload: now.Add(-time.Minute), Depth: 3},
+	)
+	defer sch.Stop()
+	clock.wait(c, time.Second)
+
+	// Due pages go back in at the depth they were found at, those deeper
+	// than MaxDepth not at all
+	q := sch.queues[sch.config.Domains[0].Domain()]
+	var queued []string
+	for q.Len() > 0 {
+		item, err := q.Dequeue()
+		c.Assert(err, gocheck.IsNil)
+		queued = append(queued, item)
+	}
+	c.Check(queued, gocheck.DeepEquals, []string{
+		encodeItem(samplesite.URL+"/latest", 1),
+		encodeItem(samplesite.URL+"/article1", 2),
+	})
+
+	// Links found on a recrawled page at MaxDepth are not followed
+	sch.curDomain, sch.curUrl, sch.curDepth = &sch.config.Domains[0], samplesite.URL+"/article1", 2
+	var p page.Page
+	c.Assert(sch.Cur(&d, &p), gocheck.IsNil)
+	c.Check(p.Depth, gocheck.Equals, 2)
+	c.Check(sch.AddTo(&d, samplesite.URL+"/article2", sch.Depth()+1), gocheck.Equals, ErrTooDeep)
+}
+
+func (s *SchedulerSuite) TestTrap(c *gocheck.C) {
+	var d domain.Domain
+	d.Traps.MaxRepeats = 1
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	sch, clock := schedule(c, d, now)
+	defer sch.Stop()
+	clock.wait(c, time.Second)
+
+	d = sch.config.Domains[0]
+	c.Check(sch.AddTo(&d, samplesite.URL+"/article1", 1), gocheck.IsNil)
+	trap := samplesite.URL + "/tag/news/tag/news"
+	c.Check(sch.AddTo(&d, trap, 1), gocheck.FitsTypeOf, &domain.TrapError{})
+
+	var list []*storage.Quarantined
+	c.Assert(sch.store.GetQuarantined(d.Domain(), &list), gocheck.IsNil)
+	c.Assert(list, gocheck.HasLen, 1)
+	c.Check(list[0].URL, gocheck.Equals, trap)
+	c.Check(list[0].Time, gocheck.Equals, now)
+}
+
+func (s *SchedulerSuite) TestRetry(c *gocheck.C) {
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	sch, clock := schedule(c, domain.Domain{}, start)
+	d := &sch.config.Domains[0]
+
+	type handout struct {
+		url            string
+		depth, attempt int
+		at             time.Time
+	}
+	handouts := make(chan handout)
+	go func() {
+		for sch.Next() {
+			h := handout{sch.curUrl, sch.curDepth, sch.Attempt(), clock.Now()}
+			if h.url == samplesite.URL+"/" && h.attempt == 1 {
+				sch.AddTo(d, samplesite.URL+"/latest", 1)
+				sch.Retry(5 * time.Second)
+			}
+			handouts <- h
+		}
+		close(handouts)
+	}()
+	next := func() handout {
+		for i := 0; i < 20; i++ {
+			clock.wait(c, time.Second)
+			clock.Advance(time.Second)
+			select {
+			case h := <-handouts:
+				return h
+			case <-time.After(50 * time.Millisecond):
+			}
+		}
+		c.Fatal("Nothing handed out")
+		return handout{}
+	}
+
+	c.Check(next(), gocheck.Equals, handout{samplesite.URL + "/", 0, 1, start.Add(time.Second)})
+	// The domain goes on with other pages while the retry waits
+	c.Check(next(), gocheck.Equals, handout{samplesite.URL + "/latest", 1, 1, start.Add(2 * time.Second)})
+	c.Check(next(), gocheck.Equals, handout{samplesite.URL + "/", 0, 2, start.Add(6 * time.Second)})
+	sch.Stop()
+	for range handouts {
+	}
 }
@@ -0,0 +1,166 @@
+// Package sitemap reads sitemaps (http://www.sitemaps.org/protocol.html) in
+// XML or plain text, gzipped or not, following sitemap index files.
+package sitemap
+
+import (
+	"bufio"
+	"bytes"
+	"code.google.com/p/go.net/html/charset"
+	"code.google.com/p/go.text/transform"
+	"compress/gzip"
+	"download"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	MaxSize  = 50 << 20 // Largest sitemap allowed, uncompressed
+	MaxDepth = 3        // Index files nested deeper than this are ignored
+)
+
+// URL is a page listed in a sitemap.
+type URL struct {
+	Loc     string
+	LastMod time.Time // Zero if the sitemap does not say
+}
+
+var ErrCharset = errors.New("Unsupported sitemap charset")
+
+// Layouts of the W3C Datetime format used by <lastmod>
+var lastModLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+	"2006-01",
+	"2006",
+}
+
+type document struct {
+	URLs     []entry `xml:"url"`
+	Sitemaps []entry `xml:"sitemap"`
+}
+
+type entry struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod"`
+}
+
+// Fetch downloads the sitemap at rawurl with f and returns the URLs it lists,
+// those of the sitemaps an index file points to included. f has to accept
+// XML and gzip bodies. A sitemap of an index that cannot be fetched is
+// skipped; its error is returned along with the URLs of the others.
+func Fetch(f download.Fetcher, rawurl string) (urls []URL, err error) {
+	seen := make(map[string]bool)
+	return fetch(f, rawurl, 0, seen)
+}
+
+func fetch(f download.Fetcher, rawurl string, depth int, seen map[string]bool) (urls []URL, err error) {
+	if seen[rawurl] || depth > MaxDepth {
+		return
+	}
+	seen[rawurl] = true
+
+	resp, err := f.Fetch(download.NewRequest(rawurl))
+	if err != nil {
+		return
+	}
+	if !resp.OK() {
+		return nil, fmt.Errorf("%s returned HTTP %d", rawurl, resp.StatusCode)
+	}
+	urls, sitemaps, err := Parse(bytes.NewReader(resp.Bytes()))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", rawurl, err)
+	}
+	// Index files may point elsewhere relative to where they ended up
+	base, err := url.Parse(resp.EffectiveURL)
+	if err != nil {
+		return
+	}
+	for _, s := range sitemaps {
+		u, perr := base.Parse(s.Loc)
+		if perr != nil {
+			continue
+		}
+		more, ferr := fetch(f, u.String(), depth+1, seen)
+		if ferr != nil {
+			err = ferr
+		}
+		urls = append(urls, more...)
+	}
+	return
+}
+
+// Parse reads a sitemap, gunzipping it first if need be. An index file
+// returns the sitemaps it lists; a plain text sitemap has one URL per line.
+func Parse(r io.Reader) (urls []URL, sitemaps []URL, err error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer gz.Close()
+		br = bufio.NewReader(gz)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(br, MaxSize))
+	if err != nil {
+		return
+	}
+
+	if trimmed := bytes.TrimSpace(data); !bytes.HasPrefix(trimmed, []byte("<")) && !bytes.HasPrefix(trimmed, []byte("\xef\xbb\xbf<")) {
+		for _, line := range strings.Split(string(trimmed), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				urls = append(urls, URL{Loc: line})
+			}
+		}
+		return
+	}
+
+	var doc document
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	dec.CharsetReader = charsetReader
+	if err = dec.Decode(&doc); err != nil {
+		return
+	}
+	for _, e := range doc.URLs {
+		if u, ok := e.url(); ok {
+			urls = append(urls, u)
+		}
+	}
+	for _, e := range doc.Sitemaps {
+		if u, ok := e.url(); ok {
+			sitemaps = append(sitemaps, u)
+		}
+	}
+	return
+}
+
+func (e entry) url() (u URL, ok bool) {
+	u.Loc = strings.TrimSpace(e.Loc)
+	if u.Loc == "" {
+		return
+	}
+	lastMod := strings.TrimSpace(e.LastMod)
+	for _, layout := range lastModLayouts {
+		if t, err := time.Parse(layout, lastMod); err == nil {
+			u.LastMod = t
+			break
+		}
+	}
+	return u, true
+}
+
+func charsetReader(label string, input io.Reader) (io.Reader, error) {
+	e, _ := charset.Lookup(label)
+	if e == nil {
+		return nil, ErrCharset
+	}
+	return transform.NewReader(input, e.NewDecoder()), nil
+}
@@ -0,0 +1,89 @@
+package sitemap
+
+import (
+	"bytes"
+	"compress/gzip"
+	"download"
+	"fmt"
+	"launchpad.net/gocheck"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type SitemapSuite struct{}
+
+var _ = gocheck.Suite(new(SitemapSuite))
+
+func Test(t *testing.T) { gocheck.TestingT(t) }
+
+const urlset = `<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+	<url><loc>http://www.moko.cc/a</loc><lastmod>2014-06-01</lastmod></url>
+	<url>
+		<loc> http://www.moko.cc/b </loc>
+		<lastmod>2014-06-02T10:30:00+08:00</lastmod>
+		<changefreq>daily</changefreq>
+	</url>
+	<url><loc>http://www.moko.cc/c</loc></url>
+	<url><lastmod>2014-06-01</lastmod></url>
+</urlset>`
+
+func (s *SitemapSuite) TestParse(c *gocheck.C) {
+	urls, sitemaps, err := Parse(strings.NewReader(urlset))
+	c.Assert(err, gocheck.IsNil)
+	c.Check(sitemaps, gocheck.HasLen, 0)
+	c.Assert(urls, gocheck.HasLen, 3)
+	c.Check(urls[0], gocheck.Equals, URL{"http://www.moko.cc/a", time.Date(2014, 6, 1, 0, 0, 0, 0, time.UTC)})
+	c.Check(urls[1].Loc, gocheck.Equals, "http://www.moko.cc/b")
+	c.Check(urls[1].LastMod.Equal(time.Date(2014, 6, 2, 2, 30, 0, 0, time.UTC)), gocheck.Equals, true)
+	c.Check(urls[2].LastMod.IsZero(), gocheck.Equals, true)
+
+	urls, _, err = Parse(strings.NewReader("http://www.moko.cc/a\r\n\r\nhttp://www.moko.cc/b\n"))
+	c.Assert(err, gocheck.IsNil)
+	c.Check(urls, gocheck.DeepEquals, []URL{{Loc: "http://www.moko.cc/a"}, {Loc: "http://www.moko.cc/b"}})
+
+	gbk := `<?xml version="1.0" encoding="GBK"?><urlset><url><loc>http://www.moko.cc/` + "\xc4\xa3\xbf\xa8" + `</loc></url></urlset>`
+	urls, _, err = Parse(strings.NewReader(gbk))
+	c.Assert(err, gocheck.IsNil)
+	c.Check(urls, gocheck.DeepEquals, []URL{{Loc: "http://www.moko.cc/模卡"}})
+}
+
+func (s *SitemapSuite) TestFetch(c *gocheck.C) {
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	fmt.Fprint(w, urlset)
+	w.Close()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sitemap_index.xml", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/xml")
+		fmt.Fprint(w, `<sitemapindex>
+			<sitemap><loc>/sitemap1.xml.gz</loc><lastmod>2014-06-01</lastmod></sitemap>
+			<sitemap><loc>/sitemap2.txt</loc></sitemap>
+			<sitemap><loc>/missing.xml</loc></sitemap>
+			<sitemap><loc>/sitemap_index.xml</loc></sitemap>
+		</sitemapindex>`)
+	})
+	mux.HandleFunc("/sitemap1.xml.gz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-gzip")
+		w.Write(gz.Bytes())
+	})
+	mux.HandleFunc("/sitemap2.txt", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "http://www.moko.cc/d\n")
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	f, err := download.New("http", download.Options{})
+	c.Assert(err, gocheck.IsNil)
+	urls, err := Fetch(f, ts.URL+"/sitemap_index.xml")
+	c.Check(err, gocheck.ErrorMatches, ".*/missing.xml returned HTTP 404")
+	locs := make([]string, len(urls))
+	for i := range urls {
+		locs[i] = urls[i].Loc
+	}
+	c.Check(locs, gocheck.DeepEquals, []string{"http://www.moko.cc/a", "http://www.moko.cc/b", "http://www.moko.cc/c", "http://www.moko.cc/d"})
+}
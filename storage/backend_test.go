@@ -1,10 +1,14 @@
 package storage
 
 import (
-	"github.com/300brand/spider/config"
-	"github.com/300brand/spider/domain"
-	"github.com/300brand/spider/page"
+	"config"
+	"domain"
+	"download"
+	"fmt"
 	"launchpad.net/gocheck"
+	"net/http"
+	"page"
+	"sync"
 	"testing"
 	"time"
 )
@@ -24,11 +28,27 @@ func testBackend(c *gocheck.C, s Storage) {
 			"/exclude",
 			"/(do not|dont)_index_me",
 		},
+		Include: []string{
+			"^/news",
+		},
 		StartPoints: []string{
 			"http://google.com/",
 			"http://google.com/starthere",
 		},
 		Delay: time.Minute,
+		Options: domain.Options{
+			Retries: 5,
+			Proxies: []string{"socks5://127.0.0.1:1080"},
+			Rules: []domain.Rule{
+				{Action: domain.RuleExclude, Target: domain.TargetParam, Param: "sort", Match: domain.MatchPrefix},
+				{Action: domain.RuleInclude, Target: domain.TargetHost, Match: domain.MatchGlob, Pattern: "*.google.com", Priority: 1},
+			},
+			HTTP: download.Profile{
+				Header:  http.Header{"Accept-Language": {"zh-CN"}},
+				Timeout: 5 * time.Second,
+				TLS:     download.TLSOptions{InsecureSkipVerify: true},
+			},
+		},
 	})
 	c.Assert(s.SaveConfig(cfg), gocheck.IsNil)
 
@@ -36,21 +56,169 @@ func testBackend(c *gocheck.C, s Storage) {
 	c.Assert(s.GetConfig(outCfg), gocheck.IsNil)
 	c.Assert(len(outCfg.Domains), gocheck.Equals, len(cfg.Domains))
 	c.Assert(len(outCfg.Domains[0].Exclude), gocheck.Equals, len(cfg.Domains[0].Exclude))
+	c.Assert(outCfg.Domains[0].Include, gocheck.DeepEquals, cfg.Domains[0].Include)
+	c.Assert(outCfg.Domains[0].Rules, gocheck.DeepEquals, cfg.Domains[0].Rules)
 	c.Assert(len(outCfg.Domains[0].StartPoints), gocheck.Equals, len(cfg.Domains[0].StartPoints))
 	c.Assert(outCfg.Domains[0].Name, gocheck.Equals, cfg.Domains[0].Name)
 	c.Assert(outCfg.Domains[0].URL, gocheck.Equals, cfg.Domains[0].URL)
+	c.Assert(outCfg.Domains[0].Retries, gocheck.Equals, 5)
+	c.Assert(outCfg.Domains[0].Proxies, gocheck.DeepEquals, []string{"socks5://127.0.0.1:1080"})
+	c.Assert(outCfg.Domains[0].HTTP, gocheck.DeepEquals, cfg.Domains[0].HTTP)
+
+	// Invalid configs are not saved
+	bad := *cfg
+	bad.Domains = append(bad.Domains, domain.Domain{URL: "http://www.google.com/", Exclude: []string{"(unclosed"}})
+	err := s.SaveConfig(&bad)
+	c.Assert(err, gocheck.FitsTypeOf, config.Errors{})
+	c.Assert(err.(config.Errors), gocheck.HasLen, 2)
+	c.Assert(s.GetConfig(outCfg), gocheck.IsNil)
+	c.Assert(len(outCfg.Domains), gocheck.Equals, 1)
 
 	// Test page in/out
 	url := "http://google.com/news.html"
 
 	p := new(page.Page)
+	c.Assert(s.GetPage("http://[::1", p), gocheck.NotNil)
+	c.Assert(s.SavePage(&page.Page{URL: "/relative"}), gocheck.NotNil)
 	c.Assert(s.GetPage(url, p), gocheck.Equals, ErrNotFound)
 	c.Assert(p.URL, gocheck.Equals, "")
 
 	p.URL = url
+	p.ETag = `"abc123"`
+	p.LastModifiedHeader = "Thu, 05 Jun 2014 16:21:15 GMT"
+	p.Size = 1024
+	p.Charset = "gbk"
 	c.Assert(s.SavePage(p), gocheck.IsNil)
 
 	*p = page.Page{}
 	c.Assert(s.GetPage(url, p), gocheck.IsNil)
 	c.Assert(p.URL, gocheck.Equals, url)
+	c.Assert(p.ETag, gocheck.Equals, `"abc123"`)
+	c.Assert(p.LastModifiedHeader, gocheck.Equals, "Thu, 05 Jun 2014 16:21:15 GMT")
+	c.Assert(p.Size, gocheck.Equals, int64(1024))
+	c.Assert(p.Charset, gocheck.Equals, "gbk")
+
+	p.ETag = `"def456"`
+	p.StatusCode = 503
+	p.Failures = 2
+	p.Error = "HTTP 503"
+	c.Assert(s.UpdatePage(p), gocheck.IsNil)
+	*p = page.Page{}
+	c.Assert(s.GetPage(url, p), gocheck.IsNil)
+	c.Assert(p.ETag, gocheck.Equals, `"def456"`)
+	c.Assert(p.StatusCode, gocheck.Equals, 503)
+	c.Assert(p.Failures, gocheck.Equals, 2)
+	c.Assert(p.Error, gocheck.Equals, "HTTP 503")
+
+	// Updating a page never saved before saves it
+	p = &page.Page{URL: "http://google.com/starthere", Failures: 1}
+	c.Assert(s.UpdatePage(p), gocheck.IsNil)
+	*p = page.Page{}
+	c.Assert(s.GetPage("http://google.com/starthere", p), gocheck.IsNil)
+	c.Assert(p.Failures, gocheck.Equals, 1)
+	c.Assert(p.NextDownload.IsZero(), gocheck.Equals, true)
+
+	// Due pages, never downloaded ones first
+	now := time.Now()
+	p = &page.Page{URL: url}
+	c.Assert(s.GetPage(url, p), gocheck.IsNil)
+	p.NextDownload, p.Interval, p.Changes = now.Add(-time.Hour), 3*time.Hour, 4
+	c.Assert(s.UpdatePage(p), gocheck.IsNil)
+	c.Assert(s.SavePage(&page.Page{URL: "http://google.com/later", NextDownload: now.Add(time.Hour)}), gocheck.IsNil)
+	var due []*page.Page
+	c.Assert(s.GetDuePages("google.com", now, 10, &due), gocheck.IsNil)
+	c.Assert(due, gocheck.HasLen, 2)
+	c.Assert(due[0].URL, gocheck.Equals, "http://google.com/starthere")
+	c.Assert(due[1].URL, gocheck.Equals, url)
+	c.Assert(due[1].NextDownload.Equal(now.Add(-time.Hour)), gocheck.Equals, true)
+	c.Assert(due[1].Interval, gocheck.Equals, 3*time.Hour)
+	c.Assert(due[1].Changes, gocheck.Equals, 4)
+	c.Assert(s.GetDuePages("google.com", now, 1, &due), gocheck.IsNil)
+	c.Assert(due, gocheck.HasLen, 1)
+
+	// Test cookies in/out
+	var cookies []*http.Cookie
+	c.Assert(s.GetCookies("google.com", &cookies), gocheck.IsNil)
+	c.Assert(len(cookies), gocheck.Equals, 0)
+
+	expires := time.Unix(2000000000, 0)
+	c.Assert(s.SaveCookies("google.com", []*http.Cookie{
+		{Name: "session", Value: "abc", Domain: ".google.com", Path: "/"},
+		{Name: "token", Value: "xyz", Domain: "www.google.com", Path: "/", Expires: expires, Secure: true, HttpOnly: true},
+	}), gocheck.IsNil)
+	c.Assert(s.GetCookies("google.com", &cookies), gocheck.IsNil)
+	c.Assert(len(cookies), gocheck.Equals, 2)
+	for _, cookie := range cookies {
+		switch cookie.Name {
+		case "session":
+			c.Assert(cookie.Domain, gocheck.Equals, ".google.com")
+			c.Assert(cookie.Expires.IsZero(), gocheck.Equals, true)
+		case "token":
+			c.Assert(cookie.Expires.Equal(expires), gocheck.Equals, true)
+			c.Assert(cookie.Secure && cookie.HttpOnly, gocheck.Equals, true)
+		default:
+			c.Fatalf("Unexpected cookie %s", cookie.Name)
+		}
+	}
+
+	c.Assert(s.SaveCookies("google.com", cookies[:1]), gocheck.IsNil)
+	c.Assert(s.GetCookies("google.com", &cookies), gocheck.IsNil)
+	c.Assert(len(cookies), gocheck.Equals, 1)
+
+	// Test adaptive delay in/out
+	var delay time.Duration
+	c.Assert(s.GetDelay("google.com", &delay), gocheck.IsNil)
+	c.Assert(delay, gocheck.Equals, time.Duration(0))
+	c.Assert(s.SaveDelay("google.com", 3*time.Second), gocheck.IsNil)
+	c.Assert(s.SaveDelay("google.com", 5*time.Second), gocheck.IsNil)
+	c.Assert(s.GetDelay("google.com", &delay), gocheck.IsNil)
+	c.Assert(delay, gocheck.Equals, 5*time.Second)
+
+	// Test quarantine in/out, latest first and one entry per URL
+	var list []*Quarantined
+	c.Assert(s.GetQuarantined("google.com", &list), gocheck.IsNil)
+	c.Assert(list, gocheck.HasLen, 0)
+	for i, link := range []string{"http://google.com/a/a/a/a", "http://google.com/cal/2014", "http://google.com/a/a/a/a"} {
+		c.Assert(s.Quarantine(&Quarantined{
+			URL:    link,
+			Domain: "google.com",
+			Reason: "trap",
+			Time:   now.Add(time.Duration(i) * time.Second),
+		}), gocheck.IsNil)
+	}
+	c.Assert(s.GetQuarantined("google.com", &list), gocheck.IsNil)
+	c.Assert(list, gocheck.HasLen, 2)
+	c.Assert(list[0].URL, gocheck.Equals, "http://google.com/a/a/a/a")
+	c.Assert(list[0].Domain, gocheck.Equals, "google.com")
+	c.Assert(list[0].Reason, gocheck.Equals, "trap")
+	c.Assert(list[0].Time.Equal(now.Add(2*time.Second)), gocheck.Equals, true)
+	c.Assert(list[1].URL, gocheck.Equals, "http://google.com/cal/2014")
+
+	// Notifiers read while the main loop writes, on domains new to the store
+	var wg sync.WaitGroup
+	errs := make(chan error, 200)
+	for i := 0; i < 2; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				errs <- s.SavePage(&page.Page{URL: fmt.Sprintf("http://site%d.com/%d", i, j)})
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			var due []*page.Page
+			for j := 0; j < 25; j++ {
+				if err := s.GetPage(fmt.Sprintf("http://site%d.com/%d", i, j), new(page.Page)); err != ErrNotFound {
+					errs <- err
+				}
+				errs <- s.GetDuePages(fmt.Sprintf("site%d.com", i), now, 10, &due)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		c.Check(err, gocheck.IsNil)
+	}
 }
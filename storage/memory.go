@@ -2,19 +2,32 @@ package storage
 
 import (
 	"config"
+	"net/http"
 	"page"
+	"sort"
+	"sync"
+	"time"
 )
 
+// Memory keeps everything in maps, for tests and one-off crawls. It is safe
+// for use by the scheduler's notifiers and main loop at once.
 type Memory struct {
-	config config.Config
-	pages  map[string]page.Page
+	mutex      sync.RWMutex
+	config     config.Config
+	pages      map[string]page.Page
+	cookies    map[string][]*http.Cookie
+	delays     map[string]time.Duration
+	quarantine map[string][]Quarantined
 }
 
 var _ Storage = new(Memory)
 
 func NewMemory() (m *Memory, err error) {
 	m = &Memory{
-		pages: make(map[string]page.Page),
+		pages:      make(map[string]page.Page),
+		cookies:    make(map[string][]*http.Cookie),
+		delays:     make(map[string]time.Duration),
+		quarantine: make(map[string][]Quarantined),
 	}
 	return
 }
@@ -24,6 +37,8 @@ func (m *Memory) Close() (err error) {
 }
 
 func (m *Memory) GetPage(url string, p *page.Page) (err error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
 	if _, ok := m.pages[url]; ok {
 		*p = m.pages[url]
 		return
@@ -33,20 +48,107 @@ func (m *Memory) GetPage(url string, p *page.Page) (err error) {
 func (m *Memory) GetPages(domain, key string, pages *[]*page.Page) (err error) {
 	return
 }
+func (m *Memory) GetDuePages(domain string, due time.Time, limit int, pages *[]*page.Page) (err error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	*pages = (*pages)[:0]
+	for url := range m.pages {
+		p := m.pages[url]
+		if name, err := p.Domain(); err == nil && name == domain && !p.NextDownload.After(due) {
+			*pages = append(*pages, &p)
+		}
+	}
+	sort.Slice(*pages, func(i, j int) bool {
+		return (*pages)[i].NextDownload.Before((*pages)[j].NextDownload)
+	})
+	if len(*pages) > limit {
+		*pages = (*pages)[:limit]
+	}
+	return
+}
 func (m *Memory) SavePage(p *page.Page) (err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, err = p.Domain(); err != nil {
+		return
+	}
 	m.pages[p.URL] = *p
 	return
 }
 func (m *Memory) UpdatePage(p *page.Page) (err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, err = p.Domain(); err != nil {
+		return
+	}
 	m.pages[p.URL] = *p
 	return
 }
 
 func (m *Memory) GetConfig(c *config.Config) (err error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
 	*c = m.config
 	return
 }
 func (m *Memory) SaveConfig(c *config.Config) (err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if err = c.Validate(); err != nil {
+		return
+	}
 	m.config = *c
 	return
 }
+
+func (m *Memory) GetCookies(domain string, cookies *[]*http.Cookie) (err error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	*cookies = append((*cookies)[:0], m.cookies[domain]...)
+	return
+}
+func (m *Memory) SaveCookies(domain string, cookies []*http.Cookie) (err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.cookies[domain] = append([]*http.Cookie(nil), cookies...)
+	return
+}
+
+func (m *Memory) GetDelay(domain string, delay *time.Duration) (err error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	*delay = m.delays[domain]
+	return
+}
+func (m *Memory) SaveDelay(domain string, delay time.Duration) (err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.delays[domain] = delay
+	return
+}
+
+func (m *Memory) Quarantine(q *Quarantined) (err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	list := m.quarantine[q.Domain]
+	for i := range list {
+		if list[i].URL == q.URL {
+			list = append(list[:i], list[i+1:]...)
+			break
+		}
+	}
+	m.quarantine[q.Domain] = append(list, *q)
+	return
+}
+
+func (m *Memory) GetQuarantined(domain string, list *[]*Quarantined) (err error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	*list = (*list)[:0]
+	q := m.quarantine[domain]
+	for i := len(q) - 1; i >= 0; i-- {
+		item := q[i]
+		*list = append(*list, &item)
+	}
+	return
+}
@@ -81,13 +81,16 @@ func (m *Mongo) Close() (err error) {
 }
 
 func (m *Mongo) GetPage(url string, p *page.Page) (err error) {
+	domain, err := page.New(url).Domain()
+	if err != nil {
+		return
+	}
 	s := m.session.Copy()
 	defer s.Close()
 	result := &mongoPage{
-		Domain: p.Domain(),
+		Domain: domain,
 	}
-	tmp := page.New(url)
-	if err = s.DB("").C(m.cName(tmp.Domain())).FindId(url).One(result); err != nil {
+	if err = s.DB("").C(m.cName(domain)).FindId(url).One(result); err != nil {
 		if err == mgo.ErrNotFound {
 			err = ErrNotFound
 		}
@@ -145,15 +148,39 @@ func (m *Mongo) GetPages(domain, key string, pages *[]*page.Page) (err error) {
 	return
 }
 
+func (m *Mongo) GetDuePages(domain string, due time.Time, limit int, pages *[]*page.Page) (err error) {
+	s := m.session.Copy()
+	defer s.Close()
+	c := s.DB("").C(m.cName(domain))
+	c.EnsureIndexKey("page.nextdownload")
+	var mPages []mongoPage
+	if err = c.Find(bson.M{"page.nextdownload": bson.M{"$lte": due}}).Sort("page.nextdownload").Limit(limit).All(&mPages); err != nil {
+		return
+	}
+	*pages = (*pages)[:0]
+	for i := range mPages {
+		*pages = append(*pages, &mPages[i].Page)
+	}
+	return
+}
+
 func (m *Mongo) SavePage(p *page.Page) (err error) {
+	domain, err := p.Domain()
+	if err != nil {
+		return
+	}
 	s := m.session.Copy()
 	defer s.Close()
-	c := s.DB("").C(m.cName(p.Domain()))
+	c := s.DB("").C(m.cName(domain))
 
-	u := p.GetURL().String()
+	parsed, err := p.GetURL()
+	if err != nil {
+		return
+	}
+	u := parsed.String()
 	mp := mongoPage{
 		Url:    u,
-		Domain: p.Domain(),
+		Domain: domain,
 		Page:   *p,
 	}
 	err = c.UpdateId(u, mp)
@@ -176,6 +203,9 @@ func (m *Mongo) GetConfig(c *config.Config) (err error) {
 }
 
 func (m *Mongo) SaveConfig(c *config.Config) (err error) {
+	if err = c.Validate(); err != nil {
+		return
+	}
 	s := m.session.Copy()
 	defer s.Close()
 	change := bson.M{
@@ -187,6 +217,36 @@ func (m *Mongo) SaveConfig(c *config.Config) (err error) {
 	return
 }
 
+func (m *Mongo) Quarantine(q *Quarantined) (err error) {
+	s := m.session.Copy()
+	defer s.Close()
+	_, err = s.DB("").C("quarantine").UpsertId(q.URL, bson.M{
+		"_id":    q.URL,
+		"domain": q.Domain,
+		"reason": q.Reason,
+		"time":   q.Time,
+	})
+	return
+}
+
+func (m *Mongo) GetQuarantined(domain string, list *[]*Quarantined) (err error) {
+	s := m.session.Copy()
+	defer s.Close()
+	var docs []struct {
+		URL    string `bson:"_id"`
+		Reason string
+		Time   time.Time
+	}
+	if err = s.DB("").C("quarantine").Find(bson.M{"domain": domain}).Sort("-time").All(&docs); err != nil {
+		return
+	}
+	*list = (*list)[:0]
+	for _, d := range docs {
+		*list = append(*list, &Quarantined{URL: d.URL, Domain: domain, Reason: d.Reason, Time: d.Time})
+	}
+	return
+}
+
 func (m *Mongo) cName(domain string) (name string) {
 	name = m.Pages + "_" + strings.Replace(domain, ".", "_", -1)
 	if m.shard && !m.sharded {
@@ -4,7 +4,10 @@ import (
 	"config"
 	"database/sql"
 	"domain"
+	"encoding/json"
+	"net/http"
 	"page"
+	"sync"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
@@ -12,11 +15,36 @@ import (
 
 type MySQL struct {
 	db      *sql.DB
+	mutex   sync.Mutex // Guards ensured
 	ensured map[string]bool
 }
 
 var _ Storage = new(MySQL)
 
+// mysqlColumn is a column added to a table after the table was first
+// released. Tables created by older versions get it when first used.
+type mysqlColumn struct {
+	Table, Name, Def string
+}
+
+var mysqlConfigColumns = []mysqlColumn{
+	{"domains", "options", "TEXT"},
+}
+
+var mysqlPageColumns = []mysqlColumn{
+	{"pages", "etag", "VARCHAR(255) NOT NULL DEFAULT ''"},
+	{"pages", "last_modified_header", "VARCHAR(64) NOT NULL DEFAULT ''"},
+	{"pages", "size", "BIGINT NOT NULL DEFAULT 0"},
+	{"pages", "status_code", "INT NOT NULL DEFAULT 0"},
+	{"pages", "failures", "INT NOT NULL DEFAULT 0"},
+	{"pages", "error", "VARCHAR(255) NOT NULL DEFAULT ''"},
+	{"pages", "charset", "VARCHAR(32) NOT NULL DEFAULT ''"},
+	{"pages", "next_download", "BIGINT NOT NULL DEFAULT 0"},
+	{"pages", "recrawl_interval", "BIGINT NOT NULL DEFAULT 0"},
+	{"pages", "changes", "INT NOT NULL DEFAULT 0"},
+	{"pages", "depth", "INT NOT NULL DEFAULT 0"},
+}
+
 func NewMySQL(dsn string) (s *MySQL, err error) {
 	db, err := sql.Open("mysql", dsn)
 	if err != nil {
@@ -38,7 +66,7 @@ func (s *MySQL) GetConfig(c *config.Config) (err error) {
 		return
 	}
 
-	rows, err := s.db.Query(`SELECT domain, name, delay, redl FROM domains`)
+	rows, err := s.db.Query(`SELECT domain, name, delay, redl, IFNULL(options, '{}') FROM domains`)
 	if err != nil {
 		return
 	}
@@ -46,18 +74,21 @@ func (s *MySQL) GetConfig(c *config.Config) (err error) {
 	c.Domains = make([]domain.Domain, 0, 128)
 	var delay, redl int64
 	var subrows *sql.Rows
-	var str string
+	var str, options string
 	for rows.Next() {
 		d := domain.Domain{
 			Exclude:     make([]string, 0, 8),
 			Include:     make([]string, 0, 8),
 			StartPoints: make([]string, 0, 8),
 		}
-		if err = rows.Scan(&d.URL, &d.Name, &delay, &redl); err != nil {
+		if err = rows.Scan(&d.URL, &d.Name, &delay, &redl, &options); err != nil {
 			return
 		}
 		d.Delay = time.Duration(delay)
 		d.Redownload = time.Duration(redl)
+		if err = json.Unmarshal([]byte(options), &d.Options); err != nil {
+			return
+		}
 
 		// Regex rules
 		for typ, f := range map[string]*[]string{
@@ -102,15 +133,21 @@ func (s *MySQL) GetConfig(c *config.Config) (err error) {
 
 func (s *MySQL) GetPage(url string, p *page.Page) (err error) {
 	p.URL = url
-	if err = s.ensureTable(p.Domain()); err != nil {
+	d, err := p.Domain()
+	if err != nil {
+		return
+	}
+	if err = s.ensureTable(d); err != nil {
 		return
 	}
 
-	var firstDownload, lastDownload, lastModified int64
+	var firstDownload, lastDownload, lastModified, next, interval int64
 	err = s.db.QueryRow(
 		`
 			SELECT
-				url, first_download, last_download, last_modified, checksum
+				url, first_download, last_download, last_modified, checksum,
+				etag, last_modified_header, size, status_code, failures, error, charset,
+				next_download, recrawl_interval, changes, depth
 			FROM pages
 			WHERE url = ?
 			LIMIT 1
@@ -122,6 +159,17 @@ func (s *MySQL) GetPage(url string, p *page.Page) (err error) {
 		&lastDownload,
 		&lastModified,
 		&p.Checksum,
+		&p.ETag,
+		&p.LastModifiedHeader,
+		&p.Size,
+		&p.StatusCode,
+		&p.Failures,
+		&p.Error,
+		&p.Charset,
+		&next,
+		&interval,
+		&p.Changes,
+		&p.Depth,
 	)
 	if err == sql.ErrNoRows {
 		p.URL = ""
@@ -130,6 +178,52 @@ func (s *MySQL) GetPage(url string, p *page.Page) (err error) {
 	p.FirstDownload = time.Unix(0, firstDownload)
 	p.LastDownload = time.Unix(0, lastDownload)
 	p.LastModified = time.Unix(0, lastModified)
+	p.NextDownload = fromNextDownload(next)
+	p.Interval = time.Duration(interval)
+	return
+}
+
+func (s *MySQL) GetDuePages(domain string, due time.Time, limit int, pages *[]*page.Page) (err error) {
+	*pages = (*pages)[:0]
+	if err = s.ensureTable(domain); err != nil {
+		return
+	}
+	rows, err := s.db.Query(
+		`
+			SELECT url
+			FROM pages
+			WHERE domain = ?
+				AND next_download <= ?
+			ORDER BY next_download
+			LIMIT ?
+		`,
+		domain,
+		due.UnixNano(),
+		limit,
+	)
+	if err != nil {
+		return
+	}
+	var urls []string
+	var url string
+	for rows.Next() {
+		if err = rows.Scan(&url); err != nil {
+			rows.Close()
+			return
+		}
+		urls = append(urls, url)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return
+	}
+	for _, url := range urls {
+		p := new(page.Page)
+		if err = s.GetPage(url, p); err != nil {
+			return
+		}
+		*pages = append(*pages, p)
+	}
 	return
 }
 
@@ -240,6 +334,9 @@ func (s *MySQL) GetPages(domain, key string, pages *[]*page.Page) (err error) {
 }
 
 func (s *MySQL) SaveConfig(c *config.Config) (err error) {
+	if err = c.Validate(); err != nil {
+		return
+	}
 	if err = s.ensureTable("config"); err != nil {
 		return
 	}
@@ -262,29 +359,36 @@ func (s *MySQL) SaveConfig(c *config.Config) (err error) {
 	}
 	defer spStmt.Close()
 
+	var options []byte
 	for _, d := range c.Domains {
 		domain := d.GetURL().Scheme + "://" + d.GetURL().Host
 
+		if options, err = json.Marshal(d.Options); err != nil {
+			return
+		}
 		_, err = s.db.Exec(
 			`INSERT INTO domains
-				(domain, name, delay, redl, del)
+				(domain, name, delay, redl, options, del)
 			VALUES
-				(?,      ?,    ?,     ?,    0  )
+				(?,      ?,    ?,     ?,    ?,       0  )
 			ON DUPLICATE KEY UPDATE
-				name  = ?,
-				delay = ?,
-				redl  = ?,
-				del   = 0
+				name    = ?,
+				delay   = ?,
+				redl    = ?,
+				options = ?,
+				del     = 0
 			`,
 			// INSERT
 			domain,
 			d.Name,
 			d.Delay.Nanoseconds(),
 			d.Redownload.Nanoseconds(),
+			string(options),
 			// ON DUPLICATE KEY UPDATE
 			d.Name,
 			d.Delay.Nanoseconds(),
 			d.Redownload.Nanoseconds(),
+			string(options),
 		)
 		if err != nil {
 			return
@@ -325,90 +429,313 @@ func (s *MySQL) SaveConfig(c *config.Config) (err error) {
 }
 
 func (s *MySQL) SavePage(p *page.Page) (err error) {
-	if err = s.ensureTable(p.Domain()); err != nil {
+	d, err := p.Domain()
+	if err != nil {
+		return
+	}
+	if err = s.ensureTable(d); err != nil {
 		return
 	}
 
 	_, err = s.db.Exec(
 		`
 			INSERT INTO pages
-				(url, domain, first_download, last_download, last_modified, checksum)
+				(url, domain, first_download, last_download, last_modified, checksum, etag, last_modified_header, size, status_code, failures, error, charset, next_download, recrawl_interval, changes, depth)
 			VALUES
-				(?,   ?,      ?,               ?,             ?,             ?       )
+				(?,   ?,      ?,               ?,             ?,             ?,        ?,    ?,                    ?,    ?,           ?,        ?,     ?,       ?,             ?,                ?,       ?    )
 			ON DUPLICATE KEY UPDATE
-				first_download = ?,
-				last_download  = ?,
-				last_modified  = IF(checksum = ?, last_modified, ?),
-				checksum       = ?
+				first_download       = ?,
+				last_download        = ?,
+				last_modified        = IF(checksum = ?, last_modified, ?),
+				checksum             = ?,
+				etag                 = ?,
+				last_modified_header = ?,
+				size                 = ?,
+				status_code          = ?,
+				failures             = ?,
+				error                = ?,
+				charset              = ?,
+				next_download        = ?,
+				recrawl_interval     = ?,
+				changes              = ?,
+				depth                = ?
 		`,
 		// INSERT INTO
 		p.URL,
-		p.Domain(),
+		d,
 		p.FirstDownload.UnixNano(),
 		p.LastDownload.UnixNano(),
 		time.Now().UnixNano(),
 		p.Checksum,
+		p.ETag,
+		p.LastModifiedHeader,
+		p.Size,
+		p.StatusCode,
+		p.Failures,
+		truncate(p.Error, 255),
+		p.Charset,
+		nextDownload(p.NextDownload),
+		int64(p.Interval),
+		p.Changes,
+		p.Depth,
 		// ON DUPLICATE KEY UPDATE
 		p.FirstDownload.UnixNano(),
 		p.LastDownload.UnixNano(),
 		p.Checksum, time.Now().UnixNano(),
 		p.Checksum,
+		p.ETag,
+		p.LastModifiedHeader,
+		p.Size,
+		p.StatusCode,
+		p.Failures,
+		truncate(p.Error, 255),
+		p.Charset,
+		nextDownload(p.NextDownload),
+		int64(p.Interval),
+		p.Changes,
+		p.Depth,
 	)
 	return
 }
 
 func (s *MySQL) UpdatePage(p *page.Page) (err error) {
-	if err = s.ensureTable(p.Domain()); err != nil {
+	d, err := p.Domain()
+	if err != nil {
+		return
+	}
+	if err = s.ensureTable(d); err != nil {
 		return
 	}
 
 	_, err = s.db.Exec(
 		`
 			INSERT INTO pages
-				(url, domain, first_download, last_download, last_modified, checksum)
+				(url, domain, first_download, last_download, last_modified, checksum, etag, last_modified_header, size, status_code, failures, error, charset, next_download, recrawl_interval, changes, depth)
 			VALUES
-				(?,   ?,      ?,               ?,             ?,             ?       )
+				(?,   ?,      ?,               ?,             ?,             ?,        ?,    ?,                    ?,    ?,           ?,        ?,     ?,       ?,             ?,                ?,       ?    )
 			ON DUPLICATE KEY UPDATE
-				first_download = ?,
-				last_download  = ?,
-				last_modified  = IF(checksum = ?, last_modified, ?),
-				checksum       = ?
+				first_download       = ?,
+				last_download        = ?,
+				last_modified        = IF(checksum = ?, last_modified, ?),
+				checksum             = ?,
+				etag                 = ?,
+				last_modified_header = ?,
+				size                 = ?,
+				status_code          = ?,
+				failures             = ?,
+				error                = ?,
+				charset              = ?,
+				next_download        = ?,
+				recrawl_interval     = ?,
+				changes              = ?,
+				depth                = ?
 		`,
 		// INSERT INTO
 		p.URL,
-		p.Domain(),
+		d,
 		p.FirstDownload.UnixNano(),
 		p.LastDownload.UnixNano(),
 		time.Now().UnixNano(),
 		p.Checksum,
+		p.ETag,
+		p.LastModifiedHeader,
+		p.Size,
+		p.StatusCode,
+		p.Failures,
+		truncate(p.Error, 255),
+		p.Charset,
+		nextDownload(p.NextDownload),
+		int64(p.Interval),
+		p.Changes,
+		p.Depth,
 		// ON DUPLICATE KEY UPDATE
 		p.FirstDownload.UnixNano(),
 		p.LastDownload.UnixNano(),
 		p.Checksum, time.Now().UnixNano(),
 		p.Checksum,
+		p.ETag,
+		p.LastModifiedHeader,
+		p.Size,
+		p.StatusCode,
+		p.Failures,
+		truncate(p.Error, 255),
+		p.Charset,
+		nextDownload(p.NextDownload),
+		int64(p.Interval),
+		p.Changes,
+		p.Depth,
 	)
 	return
 
 }
 
+func (s *MySQL) GetCookies(domain string, cookies *[]*http.Cookie) (err error) {
+	if err = s.ensureTable("cookies"); err != nil {
+		return
+	}
+
+	rows, err := s.db.Query(
+		`SELECT domain, path, name, value, expires, secure, http_only FROM cookies WHERE site = ?`,
+		domain,
+	)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	var expires int64
+	*cookies = (*cookies)[:0]
+	for rows.Next() {
+		c := new(http.Cookie)
+		if err = rows.Scan(&c.Domain, &c.Path, &c.Name, &c.Value, &expires, &c.Secure, &c.HttpOnly); err != nil {
+			return
+		}
+		if expires > 0 {
+			c.Expires = time.Unix(0, expires)
+		}
+		*cookies = append(*cookies, c)
+	}
+	return rows.Err()
+}
+
+func (s *MySQL) SaveCookies(domain string, cookies []*http.Cookie) (err error) {
+	if err = s.ensureTable("cookies"); err != nil {
+		return
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	if _, err = tx.Exec(`DELETE FROM cookies WHERE site = ?`, domain); err != nil {
+		return
+	}
+	for _, c := range cookies {
+		var expires int64
+		if !c.Expires.IsZero() {
+			expires = c.Expires.UnixNano()
+		}
+		_, err = tx.Exec(
+			`REPLACE INTO cookies
+				(site, domain, path, name, value, expires, secure, http_only)
+			VALUES
+				(?,    ?,      ?,    ?,    ?,     ?,       ?,      ?        )
+			`,
+			domain,
+			c.Domain,
+			c.Path,
+			c.Name,
+			c.Value,
+			expires,
+			c.Secure,
+			c.HttpOnly,
+		)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (s *MySQL) GetDelay(domain string, delay *time.Duration) (err error) {
+	if err = s.ensureTable("delays"); err != nil {
+		return
+	}
+	var n int64
+	switch err = s.db.QueryRow(`SELECT delay FROM delays WHERE domain = ?`, domain).Scan(&n); err {
+	case nil:
+	case sql.ErrNoRows:
+		err = nil
+	default:
+		return
+	}
+	*delay = time.Duration(n)
+	return
+}
+
+func (s *MySQL) SaveDelay(domain string, delay time.Duration) (err error) {
+	if err = s.ensureTable("delays"); err != nil {
+		return
+	}
+	_, err = s.db.Exec(`REPLACE INTO delays (domain, delay) VALUES (?, ?)`, domain, int64(delay))
+	return
+}
+
+func (s *MySQL) Quarantine(q *Quarantined) (err error) {
+	if err = s.ensureTable("quarantine"); err != nil {
+		return
+	}
+	_, err = s.db.Exec(
+		`REPLACE INTO quarantine (domain, url, reason, time) VALUES (?, ?, ?, ?)`,
+		q.Domain,
+		truncate(q.URL, 255),
+		truncate(q.Reason, 255),
+		q.Time.UnixNano(),
+	)
+	return
+}
+
+func (s *MySQL) GetQuarantined(domain string, list *[]*Quarantined) (err error) {
+	if err = s.ensureTable("quarantine"); err != nil {
+		return
+	}
+
+	rows, err := s.db.Query(
+		`SELECT url, reason, time FROM quarantine WHERE domain = ? ORDER BY time DESC`,
+		domain,
+	)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	var t int64
+	*list = (*list)[:0]
+	for rows.Next() {
+		q := &Quarantined{Domain: domain}
+		if err = rows.Scan(&q.URL, &q.Reason, &t); err != nil {
+			return
+		}
+		q.Time = time.Unix(0, t)
+		*list = append(*list, q)
+	}
+	return rows.Err()
+}
+
 func (s *MySQL) ensureTable(name string) (err error) {
 	if name == "" {
 		return ErrNotFound
 	}
 
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	if s.ensured[name] {
 		return
 	}
-	s.ensured[name] = true
 
 	switch name {
 	case "config":
-		return s.configTables()
+		err = s.configTables()
 	case "exports":
-		return s.exportsTable()
+		err = s.exportsTable()
+	case "cookies":
+		err = s.cookiesTable()
+	case "quarantine":
+		err = s.quarantineTable()
+	case "delays":
+		err = s.delaysTable()
 	default:
-		return s.domainTable(name)
+		err = s.domainTable(name)
 	}
+	s.ensured[name] = err == nil
 	return
 }
 
@@ -438,7 +765,7 @@ func (s *MySQL) configTables() (err error) {
 			return
 		}
 	}
-	return
+	return s.addColumns(mysqlConfigColumns)
 }
 
 func (s *MySQL) domainTable(name string) (err error) {
@@ -460,6 +787,75 @@ func (s *MySQL) domainTable(name string) (err error) {
 			return
 		}
 	}
+	return s.addColumns(mysqlPageColumns)
+}
+
+// addColumns adds any of columns missing from their table.
+func (s *MySQL) addColumns(columns []mysqlColumn) (err error) {
+	var n int
+	for _, col := range columns {
+		err = s.db.QueryRow(
+			`
+				SELECT COUNT(*)
+				FROM information_schema.COLUMNS
+				WHERE TABLE_SCHEMA = DATABASE()
+					AND TABLE_NAME = ?
+					AND COLUMN_NAME = ?
+			`,
+			col.Table,
+			col.Name,
+		).Scan(&n)
+		if err != nil {
+			return
+		}
+		if n > 0 {
+			continue
+		}
+		if _, err = s.db.Exec(`ALTER TABLE ` + col.Table + ` ADD COLUMN ` + col.Name + ` ` + col.Def); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (s *MySQL) cookiesTable() (err error) {
+	_, err = s.db.Exec(
+		`CREATE TABLE IF NOT EXISTS cookies (
+			site      VARCHAR(255) NOT NULL,
+			domain    VARCHAR(255) NOT NULL,
+			path      VARCHAR(128) NOT NULL,
+			name      VARCHAR(128) NOT NULL,
+			value     TEXT NOT NULL,
+			expires   BIGINT NOT NULL,
+			secure    TINYINT NOT NULL,
+			http_only TINYINT NOT NULL,
+			UNIQUE(site, domain, path, name)
+		)`,
+	)
+	return
+}
+
+func (s *MySQL) delaysTable() (err error) {
+	_, err = s.db.Exec(
+		`CREATE TABLE IF NOT EXISTS delays (
+			domain VARCHAR(255) NOT NULL PRIMARY KEY,
+			delay  BIGINT NOT NULL
+		)`,
+	)
+	return
+}
+
+func (s *MySQL) quarantineTable() (err error) {
+	_, err = s.db.Exec(
+		`CREATE TABLE IF NOT EXISTS quarantine (
+			domain VARCHAR(255) NOT NULL,
+			url    VARCHAR(255) NOT NULL,
+			reason VARCHAR(255) NOT NULL,
+			time   BIGINT NOT NULL,
+			INDEX(domain),
+			UNIQUE(url)
+		)`,
+	)
 	return
 }
 
@@ -482,3 +878,11 @@ func (s *MySQL) exportsTable() (err error) {
 	}
 	return
 }
+
+// truncate cuts s to at most n bytes so it fits a VARCHAR(n) column.
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
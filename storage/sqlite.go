@@ -5,18 +5,78 @@ import (
 	"config"
 	"database/sql"
 	"domain"
+	"encoding/json"
 	"fmt"
-	"logger"
+	_ "logger"
 	"math"
+	"net/http"
 	"os"
 	"page"
 	"path/filepath"
+	"sync"
 	"time"
 )
 
 type Sqlite struct {
-	dir string
-	dbs map[string]*sql.DB
+	dir   string
+	mutex sync.Mutex // Guards dbs, opened as domains turn up
+	dbs   map[string]*sql.DB
+}
+
+// sqliteColumn is a column added to a table after the table was first
+// released. Databases created by older versions get it when opened.
+type sqliteColumn struct {
+	Table, Name, Def string
+}
+
+var sqliteConfigColumns = []sqliteColumn{
+	{"domains", "options", "TEXT NOT NULL DEFAULT '{}'"},
+}
+
+var sqlitePageColumns = []sqliteColumn{
+	{"pages", "etag", "TEXT NOT NULL DEFAULT ''"},
+	{"pages", "last_modified_header", "TEXT NOT NULL DEFAULT ''"},
+	{"pages", "size", "INTEGER NOT NULL DEFAULT 0"},
+	{"pages", "status_code", "INTEGER NOT NULL DEFAULT 0"},
+	{"pages", "failures", "INTEGER NOT NULL DEFAULT 0"},
+	{"pages", "error", "TEXT NOT NULL DEFAULT ''"},
+	{"pages", "charset", "TEXT NOT NULL DEFAULT ''"},
+	{"pages", "next_download", "INTEGER NOT NULL DEFAULT 0"},
+	{"pages", "recrawl_interval", "INTEGER NOT NULL DEFAULT 0"},
+	{"pages", "changes", "INTEGER NOT NULL DEFAULT 0"},
+	{"pages", "depth", "INTEGER NOT NULL DEFAULT 0"},
+}
+
+// Tables added to the config database after it was first released
+var sqliteConfigTables = []string{
+	`CREATE TABLE IF NOT EXISTS includes (
+		domain TEXT NOT NULL,
+		rule   TEXT NOT NULL,
+		UNIQUE(domain, rule)
+	)`,
+}
+
+// Tables added to domain databases after they were first released
+var sqliteDomainTables = []string{
+	`CREATE TABLE IF NOT EXISTS cookies (
+		domain    TEXT NOT NULL,
+		path      TEXT NOT NULL,
+		name      TEXT NOT NULL,
+		value     TEXT NOT NULL,
+		expires   INTEGER NOT NULL,
+		secure    INTEGER NOT NULL,
+		http_only INTEGER NOT NULL,
+		UNIQUE(domain, path, name)
+	)`,
+	`CREATE TABLE IF NOT EXISTS quarantine (
+		url    TEXT NOT NULL UNIQUE,
+		reason TEXT NOT NULL,
+		time   INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS delay (
+		id    INTEGER PRIMARY KEY CHECK (id = 0),
+		delay INTEGER NOT NULL
+	)`,
 }
 
 var _ Storage = new(Sqlite)
@@ -39,11 +99,22 @@ func NewSqlite(dir string) (s *Sqlite, err error) {
 		if s.dbs[domain], err = sql.Open("sqlite3", db); err != nil {
 			return
 		}
+		if domain == "config" {
+			err = upgradeConfigDB(s.dbs[domain])
+		} else {
+			s.dbs[domain].SetMaxOpenConns(1)
+			err = upgradeDomainDB(s.dbs[domain])
+		}
+		if err != nil {
+			return
+		}
 	}
 	return
 }
 
 func (s *Sqlite) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	for _, db := range s.dbs {
 		db.Close()
 	}
@@ -58,38 +129,47 @@ func (s *Sqlite) GetConfig(c *config.Config) (err error) {
 		return
 	}
 
-	rows, err := db.Query(`SELECT domain, name, delay, redl FROM domains`)
+	rows, err := db.Query(`SELECT domain, name, delay, redl, options FROM domains`)
 	if err != nil {
 		return
 	}
 
 	var delay, redl int64
 	var subrows *sql.Rows
-	var str string
+	var str, options string
 	for rows.Next() {
 		d := domain.Domain{
 			Exclude:     make([]string, 0, 8),
+			Include:     make([]string, 0, 8),
 			StartPoints: make([]string, 0, 8),
 		}
-		if err = rows.Scan(&d.URL, &d.Name, &delay, &redl); err != nil {
+		if err = rows.Scan(&d.URL, &d.Name, &delay, &redl, &options); err != nil {
 			return
 		}
 		d.Delay = time.Duration(delay)
 		d.Redownload = time.Duration(redl)
-
-		// Exclusion rules
-		subrows, err = db.Query(`SELECT rule FROM excludes WHERE domain = ?`, d.URL)
-		if err != nil {
+		if err = json.Unmarshal([]byte(options), &d.Options); err != nil {
 			return
 		}
-		for subrows.Next() {
-			if err = subrows.Scan(&str); err != nil {
+
+		// Regex rules
+		for table, f := range map[string]*[]string{
+			"excludes": &d.Exclude,
+			"includes": &d.Include,
+		} {
+			subrows, err = db.Query(`SELECT rule FROM `+table+` WHERE domain = ?`, d.URL)
+			if err != nil {
+				return
+			}
+			for subrows.Next() {
+				if err = subrows.Scan(&str); err != nil {
+					return
+				}
+				*f = append(*f, str)
+			}
+			if err = subrows.Err(); err != nil {
 				return
 			}
-			d.Exclude = append(d.Exclude, str)
-		}
-		if err = subrows.Err(); err != nil {
-			return
 		}
 
 		// Start Points
@@ -115,16 +195,22 @@ func (s *Sqlite) GetConfig(c *config.Config) (err error) {
 
 func (s *Sqlite) GetPage(url string, p *page.Page) (err error) {
 	p.URL = url
-	db, err := s.getDB(p.Domain())
+	d, err := p.Domain()
+	if err != nil {
+		return
+	}
+	db, err := s.getDB(d)
 	if err != nil {
 		return
 	}
 
-	var firstDownload, lastDownload, lastModified int64
+	var firstDownload, lastDownload, lastModified, next, interval int64
 	err = db.QueryRow(
 		`
 			SELECT
-				url, first_download, last_download, last_modified, checksum
+				url, IFNULL(title, ''), first_download, last_download, last_modified, checksum,
+				etag, last_modified_header, size, status_code, failures, error, charset,
+				next_download, recrawl_interval, changes, depth
 			FROM pages
 			WHERE url = ?
 			LIMIT 1
@@ -132,19 +218,32 @@ func (s *Sqlite) GetPage(url string, p *page.Page) (err error) {
 		url,
 	).Scan(
 		&p.URL,
+		&p.Title,
 		&firstDownload,
 		&lastDownload,
 		&lastModified,
 		&p.Checksum,
+		&p.ETag,
+		&p.LastModifiedHeader,
+		&p.Size,
+		&p.StatusCode,
+		&p.Failures,
+		&p.Error,
+		&p.Charset,
+		&next,
+		&interval,
+		&p.Changes,
+		&p.Depth,
 	)
 	if err == sql.ErrNoRows {
 		p.URL = ""
 		err = ErrNotFound
 	}
-	p.Title = ""
 	p.FirstDownload = time.Unix(0, firstDownload)
 	p.LastDownload = time.Unix(0, lastDownload)
 	p.LastModified = time.Unix(0, lastModified)
+	p.NextDownload = fromNextDownload(next)
+	p.Interval = time.Duration(interval)
 	return
 }
 
@@ -152,7 +251,43 @@ func (s *Sqlite) GetPages(domain, key string, pages *[]*page.Page) (err error) {
 	return
 }
 
+func (s *Sqlite) GetDuePages(domain string, due time.Time, limit int, pages *[]*page.Page) (err error) {
+	*pages = (*pages)[:0]
+	db, err := s.getDB(domain)
+	if err != nil {
+		return
+	}
+	rows, err := db.Query(`SELECT url FROM pages WHERE next_download <= ? ORDER BY next_download LIMIT ?`, due.UnixNano(), limit)
+	if err != nil {
+		return
+	}
+	var urls []string
+	var url string
+	for rows.Next() {
+		if err = rows.Scan(&url); err != nil {
+			rows.Close()
+			return
+		}
+		urls = append(urls, url)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return
+	}
+	for _, url := range urls {
+		p := new(page.Page)
+		if err = s.GetPage(url, p); err != nil {
+			return
+		}
+		*pages = append(*pages, p)
+	}
+	return
+}
+
 func (s *Sqlite) SaveConfig(c *config.Config) (err error) {
+	if err = c.Validate(); err != nil {
+		return
+	}
 	db, err := s.getDB("config")
 	if err != nil {
 		return
@@ -170,25 +305,36 @@ func (s *Sqlite) SaveConfig(c *config.Config) (err error) {
 	}
 	defer exStmt.Close()
 
+	inStmt, err := db.Prepare(`INSERT OR IGNORE INTO includes (domain, rule) VALUES (?,?)`)
+	if err != nil {
+		return
+	}
+	defer inStmt.Close()
+
 	spStmt, err := db.Prepare(`INSERT OR IGNORE INTO start_points (domain, path) VALUES (?,?)`)
 	if err != nil {
 		return
 	}
 	defer spStmt.Close()
 
+	var options []byte
 	for _, d := range c.Domains {
 		domain := d.GetURL().Scheme + "://" + d.GetURL().Host
 
+		if options, err = json.Marshal(d.Options); err != nil {
+			return
+		}
 		_, err = db.Exec(
 			`INSERT OR REPLACE INTO domains
-				(domain, name, delay, redl, del)
+				(domain, name, delay, redl, options, del)
 			VALUES
-				(?,      ?,    ?,     ?,    0  )
+				(?,      ?,    ?,     ?,    ?,       0  )
 			`,
 			domain,
 			d.Name,
 			d.Delay.Nanoseconds(),
 			d.Redownload.Nanoseconds(),
+			string(options),
 		)
 		if err != nil {
 			return
@@ -204,6 +350,16 @@ func (s *Sqlite) SaveConfig(c *config.Config) (err error) {
 			}
 		}
 
+		// Domain Inclusion Rules
+		if _, err = db.Exec(`DELETE FROM includes WHERE domain = ?`, domain); err != nil {
+			return
+		}
+		for _, in := range d.Include {
+			if _, err = inStmt.Exec(domain, in); err != nil {
+				return
+			}
+		}
+
 		// Domain Start Points
 		if _, err = db.Exec(`DELETE FROM start_points WHERE domain = ?`, domain); err != nil {
 			return
@@ -232,7 +388,10 @@ func getfilepath(id int64) string {
 
 //建立文件夹
 func (s *Sqlite) SavePage(p *page.Page) (err error) {
-	d := p.Domain()
+	d, err := p.Domain()
+	if err != nil {
+		return
+	}
 	db, err := s.getDB(d) //是否存在有对应域名的数据库
 	if err != nil {
 		return
@@ -241,16 +400,27 @@ func (s *Sqlite) SavePage(p *page.Page) (err error) {
 	_, err = db.Exec(
 		`
 			INSERT INTO pages
-				(url,title, first_download, last_download, last_modified, checksum)
+				(url,title, first_download, last_download, last_modified, checksum, etag, last_modified_header, size, status_code, failures, error, charset, next_download, recrawl_interval, changes, depth)
 			VALUES
-				(?, ? ,   ?,              ?,             ?,             ? )
+				(?, ? ,   ?,              ?,             ?,             ?,        ?,    ?,                    ?,    ?,           ?,        ?,     ?,       ?,             ?,                ?,       ?    )
 		`,
 		p.URL,
 		p.Title,
 		p.FirstDownload.UnixNano(),
 		p.LastDownload.UnixNano(),
-		time.Now().UnixNano(),
+		p.LastModified.UnixNano(),
 		p.Checksum,
+		p.ETag,
+		p.LastModifiedHeader,
+		p.Size,
+		p.StatusCode,
+		p.Failures,
+		p.Error,
+		p.Charset,
+		nextDownload(p.NextDownload),
+		int64(p.Interval),
+		p.Changes,
+		p.Depth,
 	)
 	//对应储存文件得路径
 	if p.Checksum > 0 {
@@ -276,26 +446,50 @@ func (s *Sqlite) SavePage(p *page.Page) (err error) {
 
 //建立文件夹
 func (s *Sqlite) UpdatePage(p *page.Page) (err error) {
-	d := p.Domain()
+	d, err := p.Domain()
+	if err != nil {
+		return
+	}
 	db, err := s.getDB(d) //是否存在有对应域名的数据库
 	if err != nil {
 		return
 	}
 
-	_, err = db.Exec(
+	res, err := db.Exec(
 		`
-			UPDATE pages SET title = ?,first_download= ?,last_download=?,last_modified=?,checksum =? 
+			UPDATE pages SET title = ?,first_download= ?,last_download=?,last_modified=?,checksum =?,
+				etag = ?, last_modified_header = ?, size = ?, status_code = ?, failures = ?, error = ?,
+				charset = ?, next_download = ?, recrawl_interval = ?, changes = ?, depth = ?
 			where url = ?
 		`,
 		p.Title,
 		p.FirstDownload.UnixNano(),
 		p.LastDownload.UnixNano(),
-		time.Now().UnixNano(),
+		p.LastModified.UnixNano(),
 		p.Checksum,
+		p.ETag,
+		p.LastModifiedHeader,
+		p.Size,
+		p.StatusCode,
+		p.Failures,
+		p.Error,
+		p.Charset,
+		nextDownload(p.NextDownload),
+		int64(p.Interval),
+		p.Changes,
+		p.Depth,
 		p.URL,
 	)
+	if err != nil {
+		return
+	}
+	// Start points are never inserted as links, the first update saves them
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return s.SavePage(p)
+	}
 
-	if p.Checksum > 0 {
+	// A 304 leaves no body behind, keep the file from the last full download
+	if p.Checksum > 0 && len(p.GetBody()) > 0 {
 		var id int64
 		err = db.QueryRow(`SELECT id FROM pages WHERE url = ?`, p.URL).Scan(
 			&id,
@@ -306,7 +500,7 @@ func (s *Sqlite) UpdatePage(p *page.Page) (err error) {
 		//对应储存文件得路径
 		path := filepath.Join(s.dir, getfilepath(id))
 		os.MkdirAll(filepath.Dir(path), 0775)
-		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0775)
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0775)
 		if err != nil {
 			return err
 		}
@@ -316,11 +510,152 @@ func (s *Sqlite) UpdatePage(p *page.Page) (err error) {
 	return
 }
 
+func (s *Sqlite) GetCookies(domain string, cookies *[]*http.Cookie) (err error) {
+	db, err := s.getDB(domain)
+	if err != nil {
+		return
+	}
+
+	rows, err := db.Query(`SELECT domain, path, name, value, expires, secure, http_only FROM cookies`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	var expires int64
+	*cookies = (*cookies)[:0]
+	for rows.Next() {
+		c := new(http.Cookie)
+		if err = rows.Scan(&c.Domain, &c.Path, &c.Name, &c.Value, &expires, &c.Secure, &c.HttpOnly); err != nil {
+			return
+		}
+		if expires > 0 {
+			c.Expires = time.Unix(0, expires)
+		}
+		*cookies = append(*cookies, c)
+	}
+	return rows.Err()
+}
+
+func (s *Sqlite) SaveCookies(domain string, cookies []*http.Cookie) (err error) {
+	db, err := s.getDB(domain)
+	if err != nil {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	if _, err = tx.Exec(`DELETE FROM cookies`); err != nil {
+		return
+	}
+	for _, c := range cookies {
+		var expires int64
+		if !c.Expires.IsZero() {
+			expires = c.Expires.UnixNano()
+		}
+		_, err = tx.Exec(
+			`INSERT OR REPLACE INTO cookies
+				(domain, path, name, value, expires, secure, http_only)
+			VALUES
+				(?,      ?,    ?,    ?,     ?,       ?,      ?        )
+			`,
+			c.Domain,
+			c.Path,
+			c.Name,
+			c.Value,
+			expires,
+			c.Secure,
+			c.HttpOnly,
+		)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (s *Sqlite) GetDelay(domain string, delay *time.Duration) (err error) {
+	db, err := s.getDB(domain)
+	if err != nil {
+		return
+	}
+	var n int64
+	switch err = db.QueryRow(`SELECT delay FROM delay WHERE id = 0`).Scan(&n); err {
+	case nil:
+	case sql.ErrNoRows:
+		err = nil
+	default:
+		return
+	}
+	*delay = time.Duration(n)
+	return
+}
+
+func (s *Sqlite) SaveDelay(domain string, delay time.Duration) (err error) {
+	db, err := s.getDB(domain)
+	if err != nil {
+		return
+	}
+	_, err = db.Exec(`INSERT OR REPLACE INTO delay (id, delay) VALUES (0, ?)`, int64(delay))
+	return
+}
+
+func (s *Sqlite) Quarantine(q *Quarantined) (err error) {
+	db, err := s.getDB(q.Domain)
+	if err != nil {
+		return
+	}
+	_, err = db.Exec(
+		`INSERT OR REPLACE INTO quarantine (url, reason, time) VALUES (?, ?, ?)`,
+		q.URL,
+		q.Reason,
+		q.Time.UnixNano(),
+	)
+	return
+}
+
+func (s *Sqlite) GetQuarantined(domain string, list *[]*Quarantined) (err error) {
+	db, err := s.getDB(domain)
+	if err != nil {
+		return
+	}
+
+	rows, err := db.Query(`SELECT url, reason, time FROM quarantine ORDER BY time DESC`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	var t int64
+	*list = (*list)[:0]
+	for rows.Next() {
+		q := &Quarantined{Domain: domain}
+		if err = rows.Scan(&q.URL, &q.Reason, &t); err != nil {
+			return
+		}
+		q.Time = time.Unix(0, t)
+		*list = append(*list, q)
+	}
+	return rows.Err()
+}
+
 func (s *Sqlite) getDB(name string) (db *sql.DB, err error) {
 	if name == "" {
 		return nil, ErrNotFound
 	}
 
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	db, ok := s.dbs[name]
 	if ok {
 		return
@@ -360,6 +695,9 @@ func (s *Sqlite) configDB() (db *sql.DB, err error) {
 			return
 		}
 	}
+	if err = upgradeConfigDB(db); err != nil {
+		return
+	}
 	s.dbs["config"] = db
 	return
 }
@@ -369,6 +707,9 @@ func (s *Sqlite) domainDB(name string) (db *sql.DB, err error) {
 	if err != nil {
 		return
 	}
+	// Notifiers and the main loop share domain databases, one connection
+	// keeps their writes from failing with "database is locked"
+	db.SetMaxOpenConns(1)
 	creates := []string{
 		`CREATE TABLE pages (
                         id             INTEGER PRIMARY KEY autoincrement,
@@ -385,7 +726,73 @@ func (s *Sqlite) domainDB(name string) (db *sql.DB, err error) {
 			return
 		}
 	}
+	if err = upgradeDomainDB(db); err != nil {
+		return
+	}
 	s.dbs[name] = db
 	//logger.Error.Printf("create dB %s OK", name)
 	return
 }
+
+// upgradeConfigDB brings the config database created by an older version up
+// to date.
+func upgradeConfigDB(db *sql.DB) (err error) {
+	for _, create := range sqliteConfigTables {
+		if _, err = db.Exec(create); err != nil {
+			return
+		}
+	}
+	return addColumns(db, sqliteConfigColumns)
+}
+
+// upgradeDomainDB brings a domain database created by an older version up to
+// date.
+func upgradeDomainDB(db *sql.DB) (err error) {
+	for _, create := range sqliteDomainTables {
+		if _, err = db.Exec(create); err != nil {
+			return
+		}
+	}
+	return addColumns(db, sqlitePageColumns)
+}
+
+// addColumns adds any of columns missing from their table.
+func addColumns(db *sql.DB, columns []sqliteColumn) (err error) {
+	have := make(map[string]map[string]bool)
+	for _, col := range columns {
+		if have[col.Table] == nil {
+			if have[col.Table], err = tableColumns(db, col.Table); err != nil {
+				return
+			}
+		}
+		if have[col.Table][col.Name] {
+			continue
+		}
+		if _, err = db.Exec(`ALTER TABLE ` + col.Table + ` ADD COLUMN ` + col.Name + ` ` + col.Def); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func tableColumns(db *sql.DB, table string) (cols map[string]bool, err error) {
+	rows, err := db.Query(`PRAGMA table_info(` + table + `)`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	var (
+		cid, notNull, pk int
+		name, typ        string
+		dflt             sql.NullString
+	)
+	cols = make(map[string]bool)
+	for rows.Next() {
+		if err = rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk); err != nil {
+			return
+		}
+		cols[name] = true
+	}
+	return cols, rows.Err()
+}
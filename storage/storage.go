@@ -3,17 +3,51 @@ package storage
 import (
 	"config"
 	"errors"
+	"net/http"
 	"page"
+	"time"
 )
 
 type Storage interface {
 	Close() error
 	GetPage(url string, p *page.Page) error
 	GetPages(domain, key string, pages *[]*page.Page) error
+	GetDuePages(domain string, due time.Time, limit int, pages *[]*page.Page) error // Pages with a NextDownload by due, the earliest first
 	SavePage(p *page.Page) error
 	UpdatePage(p *page.Page) error
 	GetConfig(c *config.Config) error
-	SaveConfig(c *config.Config) error
+	SaveConfig(c *config.Config) error // Fails with config.Errors if c does not validate
+	GetCookies(domain string, cookies *[]*http.Cookie) error
+	SaveCookies(domain string, cookies []*http.Cookie) error
+	GetDelay(domain string, delay *time.Duration) error // 0 if none was saved
+	SaveDelay(domain string, delay time.Duration) error
+	Quarantine(q *Quarantined) error
+	GetQuarantined(domain string, list *[]*Quarantined) error // Latest first
+}
+
+// Quarantined is a URL kept out of the queue because it looks like a
+// crawler trap, see domain.Domain.CheckTrap, held for review.
+type Quarantined struct {
+	URL    string
+	Domain string
+	Reason string
+	Time   time.Time
 }
 
 var ErrNotFound = errors.New("Not found")
+
+// nextDownload is how backends keep page.Page.NextDownload, 0 if it is not
+// set.
+func nextDownload(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromNextDownload(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
@@ -0,0 +1,39 @@
+package warc
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// SURT turns a URL into the Sort-friendly URI Reordering Transform used as
+// the CDX key: scheme and "www." dropped, host labels reversed, query
+// arguments sorted, e.g. "http://www.Moko.cc/a?b=1&a=2" becomes
+// "cc,moko)/a?a=2&b=1".
+func SURT(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Host == "" {
+		return strings.ToLower(rawurl)
+	}
+	host := strings.ToLower(u.Hostname())
+	host = strings.TrimPrefix(host, "www.")
+	labels := strings.Split(host, ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	key := strings.Join(labels, ",")
+	if port := u.Port(); port != "" && !(u.Scheme == "http" && port == "80") && !(u.Scheme == "https" && port == "443") {
+		key += ":" + port
+	}
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	key += ")" + strings.ToLower(path)
+	if u.RawQuery != "" {
+		args := strings.Split(u.RawQuery, "&")
+		sort.Strings(args)
+		key += "?" + strings.ToLower(strings.Join(args, "&"))
+	}
+	return key
+}
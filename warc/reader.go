@@ -0,0 +1,121 @@
+package warc
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrFormat = errors.New("Not a WARC record")
+
+// Reader reads the records of a WARC file, gzipped or not, in order.
+type Reader struct {
+	r *bufio.Reader
+}
+
+func NewReader(r io.Reader) (rd *Reader, err error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		// Every record is a gzip member, read them as one stream
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		br = bufio.NewReader(gz)
+	}
+	rd = &Reader{r: br}
+	return
+}
+
+// Next returns the next record, io.EOF after the last one. Header keys are
+// kept as they were written, see Field for case insensitive lookups.
+func (rd *Reader) Next() (r *Record, err error) {
+	version, err := rd.line()
+	if err != nil {
+		return
+	}
+	if !strings.HasPrefix(version, "WARC/") {
+		return nil, ErrFormat
+	}
+
+	r = &Record{Header: make(http.Header)}
+	length := int64(-1)
+	for {
+		line, err := rd.line()
+		if err != nil {
+			return nil, unexpected(err)
+		}
+		if line == "" {
+			break
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			return nil, ErrFormat
+		}
+		name, value := line[:i], strings.TrimSpace(line[i+1:])
+		switch strings.ToLower(name) {
+		case "warc-type":
+			r.Type = value
+		case "warc-record-id":
+			r.ID = value
+		case "warc-date":
+			r.Date, _ = time.Parse(time.RFC3339Nano, value)
+		case "content-length":
+			if length, err = strconv.ParseInt(value, 10, 64); err != nil || length < 0 {
+				return nil, ErrFormat
+			}
+		default:
+			r.Header[name] = append(r.Header[name], value)
+		}
+	}
+	if length < 0 {
+		return nil, ErrFormat
+	}
+
+	r.Content = make([]byte, length)
+	if _, err = io.ReadFull(rd.r, r.Content); err != nil {
+		return nil, unexpected(err)
+	}
+	var end [4]byte
+	if _, err = io.ReadFull(rd.r, end[:]); err != nil {
+		return nil, unexpected(err)
+	}
+	if string(end[:]) != "\r\n\r\n" {
+		return nil, ErrFormat
+	}
+	return
+}
+
+// Field returns the first value of the named header of r, ignoring case.
+func (r *Record) Field(name string) string {
+	if v := r.Header[name]; len(v) > 0 {
+		return v[0]
+	}
+	for k, v := range r.Header {
+		if strings.EqualFold(k, name) && len(v) > 0 {
+			return v[0]
+		}
+	}
+	return ""
+}
+
+func (rd *Reader) line() (line string, err error) {
+	line, err = rd.r.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = io.ErrUnexpectedEOF
+	}
+	return strings.TrimRight(line, "\r\n"), err
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
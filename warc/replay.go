@@ -0,0 +1,183 @@
+package warc
+
+import (
+	"bufio"
+	"bytes"
+	"download"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrNotArchived = errors.New("Not in the archive")
+
+// Replay is a download.Fetcher answering from recorded WARC files instead of
+// the network, so a crawl can be rerun offline. Redirects are followed
+// through the archive like the live fetchers do. A URL recorded more than
+// once answers with its last recording; the request method is not looked at.
+type Replay struct {
+	mutex     sync.RWMutex
+	responses map[string]*Record
+	errs      map[string]error
+}
+
+var _ download.Fetcher = new(Replay)
+
+// Errors a recorded fetch may have returned along with its response
+var replayErrs = []error{download.ErrTooLarge, download.ErrContentType}
+
+// NewReplay loads the responses of the WARC files at paths. A directory
+// stands for the .warc and .warc.gz files in it, read in name order, which
+// for files of a Writer is the order they were written in.
+func NewReplay(paths ...string) (rp *Replay, err error) {
+	rp = &Replay{
+		responses: make(map[string]*Record),
+		errs:      make(map[string]error),
+	}
+	for _, path := range paths {
+		files := []string{path}
+		if fi, err := os.Stat(path); err != nil {
+			return nil, err
+		} else if fi.IsDir() {
+			if files, err = Files(path); err != nil {
+				return nil, err
+			}
+		}
+		for _, name := range files {
+			if err = rp.load(name); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return
+}
+
+// Files returns the WARC files in dir, sorted by name.
+func Files(dir string) (files []string, err error) {
+	for _, pattern := range []string{"*.warc", "*.warc.gz"} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	sort.Strings(files)
+	return
+}
+
+// Len returns the number of URLs with a recorded response.
+func (rp *Replay) Len() int {
+	rp.mutex.RLock()
+	defer rp.mutex.RUnlock()
+	return len(rp.responses)
+}
+
+func (rp *Replay) Fetch(req *download.Request) (resp *download.Response, err error) {
+	rp.mutex.RLock()
+	defer rp.mutex.RUnlock()
+
+	var hops []*download.Response
+	uri := req.URL
+	for {
+		r, ok := rp.responses[uri]
+		if !ok {
+			return nil, ErrNotArchived
+		}
+		if resp, err = replay(uri, r); err != nil {
+			return nil, err
+		}
+		loc := resp.Header.Get("Location")
+		if resp.StatusCode < 300 || resp.StatusCode >= 400 || loc == "" || req.Method == "HEAD" {
+			break
+		}
+		if len(hops) >= download.DefaultMaxRedirects {
+			return nil, download.ErrTooManyRedirects
+		}
+		base, err := url.Parse(uri)
+		if err != nil {
+			return nil, err
+		}
+		next, err := base.Parse(loc)
+		if err != nil {
+			return nil, err
+		}
+		hops = append(hops, resp)
+		uri = next.String()
+	}
+	resp.URL = req.URL
+	resp.Redirects = hops
+	return resp, rp.errs[req.URL]
+}
+
+func (rp *Replay) load(name string) (err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	rd, err := NewReader(f)
+	if err != nil {
+		return
+	}
+	for {
+		r, err := rd.Next()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		uri := r.Field("WARC-Target-URI")
+		switch {
+		case uri == "":
+		case r.Type == "response":
+			rp.responses[uri] = r
+		case r.Type == "metadata":
+			// Written after every fetch, so it tells the outcome of the
+			// latest one
+			delete(rp.errs, uri)
+			for _, e := range replayErrs {
+				if bytes.Contains(r.Content, []byte("error: "+e.Error()+"\r\n")) {
+					rp.errs[uri] = e
+				}
+			}
+		}
+	}
+}
+
+// replay turns a response record for uri back into a Response.
+func replay(uri string, r *Record) (resp *download.Response, err error) {
+	hresp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(r.Content)), nil)
+	if err != nil {
+		return
+	}
+	defer hresp.Body.Close()
+	// Bodies cut off by a limit or skipped for their type come up short of
+	// their Content-Length
+	data, err := ioutil.ReadAll(hresp.Body)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return
+	}
+	resp = &download.Response{
+		URL:          uri,
+		EffectiveURL: uri,
+		StatusCode:   hresp.StatusCode,
+		Header:       hresp.Header,
+		ContentType:  hresp.Header.Get("Content-Type"),
+		Proto:        hresp.Proto,
+		RemoteAddr:   r.Field("WARC-IP-Address"),
+		Date:         r.Date,
+	}
+	if resp.Date.IsZero() {
+		resp.Date = time.Now()
+	}
+	resp.SetBody(data)
+	return resp, nil
+}
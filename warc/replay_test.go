@@ -0,0 +1,66 @@
+package warc
+
+import (
+	"download"
+	"launchpad.net/gocheck"
+	"net/http"
+)
+
+func (s *WriterSuite) record(c *gocheck.C, gz bool, max int64, urls ...string) {
+	w, err := NewWriter(s.dir, "test", 0, gz)
+	c.Assert(err, gocheck.IsNil)
+	download.SetRecorder(w)
+	defer download.SetRecorder(nil)
+	f, err := download.New("http", download.Options{MaxBodySize: max})
+	c.Assert(err, gocheck.IsNil)
+	for _, u := range urls {
+		f.Fetch(download.NewRequest(u))
+	}
+	c.Assert(w.Close(), gocheck.IsNil)
+}
+
+func (s *WriterSuite) TestReplay(c *gocheck.C) {
+	for _, gz := range []bool{true, false} {
+		s.dir = c.MkDir()
+		s.record(c, gz, 50, s.ts.URL+"/old", s.ts.URL+"/missing", s.ts.URL+"/big")
+		rp, err := NewReplay(s.dir)
+		c.Assert(err, gocheck.IsNil)
+		c.Check(rp.Len(), gocheck.Equals, 4)
+
+		resp, err := rp.Fetch(download.NewRequest(s.ts.URL + "/old"))
+		c.Assert(err, gocheck.IsNil)
+		c.Check(resp.URL, gocheck.Equals, s.ts.URL+"/old")
+		c.Check(resp.EffectiveURL, gocheck.Equals, s.ts.URL+"/new?b=2&a=1")
+		c.Check(resp.StatusCode, gocheck.Equals, http.StatusOK)
+		c.Check(resp.ContentType, gocheck.Equals, "text/html; charset=utf-8")
+		c.Check(string(resp.Bytes()), gocheck.Equals, "<html><title>New</title></html>")
+		c.Assert(resp.Redirects, gocheck.HasLen, 1)
+		c.Check(resp.Redirects[0].StatusCode, gocheck.Equals, http.StatusMovedPermanently)
+		c.Check(resp.Redirects[0].Header.Get("Location"), gocheck.Equals, "/new?b=2&a=1")
+
+		resp, err = rp.Fetch(download.NewRequest(s.ts.URL + "/missing"))
+		c.Assert(err, gocheck.IsNil)
+		c.Check(resp.StatusCode, gocheck.Equals, http.StatusNotFound)
+
+		resp, err = rp.Fetch(download.NewRequest(s.ts.URL + "/big"))
+		c.Check(err, gocheck.Equals, download.ErrTooLarge)
+		c.Check(resp.StatusCode, gocheck.Equals, http.StatusOK)
+
+		resp, err = rp.Fetch(download.NewRequest(s.ts.URL + "/never"))
+		c.Check(err, gocheck.Equals, ErrNotArchived)
+		c.Check(resp, gocheck.IsNil)
+	}
+}
+
+func (s *WriterSuite) TestReplayLatest(c *gocheck.C) {
+	s.record(c, true, 50, s.ts.URL+"/big")
+	s.record(c, true, 0, s.ts.URL+"/big")
+	files, err := Files(s.dir)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(files, gocheck.HasLen, 2)
+	rp, err := NewReplay(s.dir)
+	c.Assert(err, gocheck.IsNil)
+	resp, err := rp.Fetch(download.NewRequest(s.ts.URL + "/big"))
+	c.Assert(err, gocheck.IsNil)
+	c.Check(resp.Size, gocheck.Equals, int64(100))
+}
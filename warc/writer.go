@@ -0,0 +1,439 @@
+// Package warc archives crawls as WARC 1.1 files (ISO 28500), readable by
+// the usual web archive tools, with a CDX index next to each file.
+package warc
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha1"
+	"download"
+	"encoding/base32"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	Version        = "WARC/1.1"
+	CDXHeader      = " CDX N b a m s k r M S V g"
+	DefaultMaxSize = 1 << 30
+)
+
+// Writer appends records to WARC files in a directory, starting a new file
+// whenever the current one grew past MaxSize. It is safe for concurrent use.
+type Writer struct {
+	Dir     string // Where the .warc(.gz) and .cdx files go
+	Prefix  string // Start of every file name
+	MaxSize int64  // Size to rotate at
+	Gzip    bool   // Compress every record as a gzip member of its own
+	mutex   sync.Mutex
+	file    *os.File
+	cdx     *bufio.Writer
+	cdxFile *os.File
+	name    string
+	offset  int64
+	serial  int
+}
+
+var _ download.Recorder = new(Writer)
+
+// Record is a single WARC record. Header holds the named fields besides
+// WARC-Type, WARC-Record-ID, WARC-Date and Content-Length, which Write sets.
+// Its keys are written as they are, so set them directly rather than through
+// Header.Set, which would turn WARC-IP-Address into Warc-Ip-Address.
+type Record struct {
+	Type    string
+	Header  http.Header
+	Content []byte
+	Date    time.Time
+	ID      string // Set by Write if empty
+}
+
+func NewWriter(dir, prefix string, maxSize int64, gz bool) (w *Writer, err error) {
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+	w = &Writer{
+		Dir:     dir,
+		Prefix:  prefix,
+		MaxSize: maxSize,
+		Gzip:    gz,
+	}
+	return
+}
+
+// Close finishes the current file and its index.
+func (w *Writer) Close() (err error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.closeFile()
+}
+
+// Write appends r to the current file. Response records get a CDX line.
+func (w *Writer) Write(r *Record) (err error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.file == nil || w.offset >= w.MaxSize {
+		if err = w.rotate(); err != nil {
+			return
+		}
+	}
+	return w.write(r)
+}
+
+// Record implements download.Recorder: every redirect hop and the final
+// answer become a request and a response record, followed by a metadata
+// record for the fetch.
+func (w *Writer) Record(req *download.Request, resp *download.Response, fetchErr error) (err error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.file == nil || w.offset >= w.MaxSize {
+		if err = w.rotate(); err != nil {
+			return
+		}
+	}
+
+	date := resp.Date
+	if date.IsZero() {
+		date = time.Now()
+	}
+	method := req.Method
+	if method == "" {
+		method = "GET"
+	}
+	exchanges := make([]*download.Response, 0, len(resp.Redirects)+1)
+	exchanges = append(append(exchanges, resp.Redirects...), resp)
+	body := req.Body
+	for i, ex := range exchanges {
+		uri := ex.EffectiveURL
+		if uri == "" {
+			uri = ex.URL
+		}
+		if i > 0 {
+			// Like browsers, net/http only keeps method and body across
+			// 307 and 308
+			switch exchanges[i-1].StatusCode {
+			case http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+			default:
+				if method != "HEAD" {
+					method = "GET"
+				}
+				body = nil
+			}
+		}
+
+		response := &Record{
+			Type: "response",
+			Date: date,
+			Header: http.Header{
+				"WARC-Target-URI": {uri},
+				"Content-Type":    {"application/http;msgtype=response"},
+			},
+			Content: responseBlock(ex),
+		}
+		response.ID = newID()
+		if ex.RemoteAddr != "" {
+			response.Header["WARC-IP-Address"] = []string{hostOnly(ex.RemoteAddr)}
+		}
+		if ex == resp {
+			// Bodies cut off or never read, their Content-Length says
+			// otherwise
+			switch fetchErr {
+			case download.ErrTooLarge:
+				response.Header["WARC-Truncated"] = []string{"length"}
+			case download.ErrContentType:
+				response.Header["WARC-Truncated"] = []string{"unspecified"}
+			}
+		}
+		request := &Record{
+			Type: "request",
+			Date: date,
+			Header: http.Header{
+				"WARC-Target-URI":    {uri},
+				"WARC-Concurrent-To": {response.ID},
+				"Content-Type":       {"application/http;msgtype=request"},
+			},
+			Content: requestBlock(method, uri, ex.RequestHeader, body),
+		}
+		if err = w.write(request); err != nil {
+			return
+		}
+		if err = w.write(response); err != nil {
+			return
+		}
+	}
+
+	var fields bytes.Buffer
+	fmt.Fprintf(&fields, "fetchTimeMs: %d\r\n", resp.Timing.Total/time.Millisecond)
+	for _, h := range resp.Redirects {
+		fmt.Fprintf(&fields, "via: %s\r\n", h.URL)
+	}
+	if fetchErr != nil {
+		fmt.Fprintf(&fields, "error: %s\r\n", fetchErr)
+	}
+	return w.write(&Record{
+		Type: "metadata",
+		Date: date,
+		Header: http.Header{
+			"WARC-Target-URI": {resp.URL},
+			"Content-Type":    {"application/warc-fields"},
+		},
+		Content: fields.Bytes(),
+	})
+}
+
+func (w *Writer) write(r *Record) (err error) {
+	if r.ID == "" {
+		r.ID = newID()
+	}
+	if r.Date.IsZero() {
+		r.Date = time.Now()
+	}
+
+	var head bytes.Buffer
+	head.WriteString(Version + "\r\n")
+	fmt.Fprintf(&head, "WARC-Type: %s\r\n", r.Type)
+	fmt.Fprintf(&head, "WARC-Record-ID: %s\r\n", r.ID)
+	fmt.Fprintf(&head, "WARC-Date: %s\r\n", r.Date.UTC().Format(time.RFC3339))
+	if r.Type != "warcinfo" {
+		fmt.Fprintf(&head, "WARC-Warcinfo-ID: %s\r\n", w.infoID())
+	}
+	fmt.Fprintf(&head, "WARC-Block-Digest: %s\r\n", digest(r.Content))
+	if r.Type == "response" {
+		if i := bytes.Index(r.Content, []byte("\r\n\r\n")); i >= 0 {
+			fmt.Fprintf(&head, "WARC-Payload-Digest: %s\r\n", digest(r.Content[i+4:]))
+		}
+	}
+	writeHeader(&head, r.Header)
+	fmt.Fprintf(&head, "Content-Length: %d\r\n\r\n", len(r.Content))
+
+	start := w.offset
+	var out io.Writer = w.file
+	var gz *gzip.Writer
+	if w.Gzip {
+		gz = gzip.NewWriter(w.file)
+		out = gz
+	}
+	for _, b := range [][]byte{head.Bytes(), r.Content, []byte("\r\n\r\n")} {
+		if _, err = out.Write(b); err != nil {
+			return
+		}
+	}
+	if gz != nil {
+		if err = gz.Close(); err != nil {
+			return
+		}
+	}
+	if w.offset, err = w.file.Seek(0, io.SeekCurrent); err != nil {
+		return
+	}
+
+	if uri := r.Header["WARC-Target-URI"]; len(uri) > 0 && (r.Type == "response" || r.Type == "revisit") {
+		return w.index(r, uri[0], start, w.offset-start)
+	}
+	return
+}
+
+// index adds the CDX line of a response record.
+func (w *Writer) index(r *Record, uri string, offset, length int64) (err error) {
+	mime, status, redirect := "-", "-", "-"
+	payload := r.Content
+	if resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(r.Content)), nil); err == nil {
+		status = strconv.Itoa(resp.StatusCode)
+		if ct := resp.Header.Get("Content-Type"); ct != "" {
+			mime = strings.SplitN(ct, ";", 2)[0]
+		}
+		if loc := resp.Header.Get("Location"); loc != "" {
+			redirect = loc
+		}
+		if i := bytes.Index(r.Content, []byte("\r\n\r\n")); i >= 0 {
+			payload = r.Content[i+4:]
+		}
+	}
+	_, err = fmt.Fprintf(w.cdx, "%s %s %s %s %s %s %s - %d %d %s\n",
+		SURT(uri),
+		r.Date.UTC().Format("20060102150405"),
+		uri,
+		cdxField(mime),
+		status,
+		strings.TrimPrefix(digest(payload), "sha1:"),
+		cdxField(redirect),
+		length,
+		offset,
+		filepath.Base(w.name),
+	)
+	if err == nil {
+		err = w.cdx.Flush()
+	}
+	return
+}
+
+func (w *Writer) rotate() (err error) {
+	if err = w.closeFile(); err != nil {
+		return
+	}
+	// Another Writer may have started a file in the same second
+	for {
+		w.serial++
+		w.name = filepath.Join(w.Dir, fmt.Sprintf("%s-%s-%05d.warc", w.Prefix, time.Now().UTC().Format("20060102150405"), w.serial))
+		if w.Gzip {
+			w.name += ".gz"
+		}
+		if w.file, err = os.OpenFile(w.name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644); !os.IsExist(err) {
+			break
+		}
+	}
+	if err != nil {
+		return
+	}
+	if w.cdxFile, err = os.Create(w.name + ".cdx"); err != nil {
+		return
+	}
+	w.cdx = bufio.NewWriter(w.cdxFile)
+	w.cdx.WriteString(CDXHeader + "\n")
+	w.offset = 0
+
+	var info bytes.Buffer
+	fmt.Fprintf(&info, "software: pachong\r\n")
+	fmt.Fprintf(&info, "format: WARC File Format 1.1\r\n")
+	fmt.Fprintf(&info, "conformsTo: http://iipc.github.io/warc-specifications/specifications/warc-format/warc-1.1/\r\n")
+	if host, err := os.Hostname(); err == nil {
+		fmt.Fprintf(&info, "hostname: %s\r\n", host)
+	}
+	return w.write(&Record{
+		Type:    "warcinfo",
+		ID:      w.infoID(),
+		Header:  http.Header{"WARC-Filename": {filepath.Base(w.name)}, "Content-Type": {"application/warc-fields"}},
+		Content: info.Bytes(),
+	})
+}
+
+func (w *Writer) closeFile() (err error) {
+	if w.file == nil {
+		return
+	}
+	if err = w.cdx.Flush(); err != nil {
+		return
+	}
+	if err = w.cdxFile.Close(); err != nil {
+		return
+	}
+	err = w.file.Close()
+	w.file, w.cdx, w.cdxFile = nil, nil, nil
+	return
+}
+
+// infoID is the ID of the warcinfo record of the current file, derived from
+// its name so it does not have to be kept around.
+func (w *Writer) infoID() string {
+	sum := sha1.Sum([]byte(w.name))
+	return fmt.Sprintf("<urn:uuid:%x-%x-%x-%x-%x>", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+func requestBlock(method, uri string, header http.Header, body []byte) []byte {
+	var b bytes.Buffer
+	target := uri
+	if req, err := http.NewRequest(method, uri, nil); err == nil {
+		target = req.URL.RequestURI()
+		if header.Get("Host") == "" {
+			header = cloneHeader(header)
+			header.Set("Host", req.URL.Host)
+		}
+	}
+	fmt.Fprintf(&b, "%s %s HTTP/1.1\r\n", method, target)
+	writeHeader(&b, redact(header))
+	b.WriteString("\r\n")
+	b.Write(body)
+	return b.Bytes()
+}
+
+func responseBlock(resp *download.Response) []byte {
+	var b bytes.Buffer
+	proto := resp.Proto
+	if proto == "" {
+		proto = "HTTP/1.1"
+	}
+	fmt.Fprintf(&b, "%s %d %s\r\n", proto, resp.StatusCode, http.StatusText(resp.StatusCode))
+	writeHeader(&b, resp.Header)
+	b.WriteString("\r\n")
+	b.Write(resp.Bytes())
+	return b.Bytes()
+}
+
+// writeHeader writes h sorted by name, so records come out the same every
+// time.
+func writeHeader(b *bytes.Buffer, h http.Header) {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range h[k] {
+			v = strings.NewReplacer("\r", " ", "\n", " ").Replace(v)
+			fmt.Fprintf(b, "%s: %s\r\n", k, v)
+		}
+	}
+}
+
+// Request headers that carry credentials, archived without their values
+var secretHeaders = []string{"Authorization", "Cookie", "Proxy-Authorization"}
+
+// redact returns a copy of h with the values of secretHeaders replaced.
+func redact(h http.Header) (c http.Header) {
+	c = cloneHeader(h)
+	for _, k := range secretHeaders {
+		if _, ok := c[k]; ok {
+			c[k] = []string{"redacted"}
+		}
+	}
+	return
+}
+
+func cloneHeader(h http.Header) http.Header {
+	c := make(http.Header, len(h)+1)
+	for k, v := range h {
+		c[k] = v
+	}
+	return c
+}
+
+func digest(b []byte) string {
+	sum := sha1.Sum(b)
+	return "sha1:" + base32.StdEncoding.EncodeToString(sum[:])
+}
+
+func newID() string {
+	var u [16]byte
+	rand.Read(u[:])
+	u[6] = u[6]&0x0f | 0x40 // Version 4
+	u[8] = u[8]&0x3f | 0x80 // Variant 10
+	return fmt.Sprintf("<urn:uuid:%x-%x-%x-%x-%x>", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
+
+func hostOnly(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+func cdxField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return strings.Replace(s, " ", "%20", -1)
+}
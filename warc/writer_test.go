@@ -0,0 +1,241 @@
+package warc
+
+import (
+	"bufio"
+	"compress/gzip"
+	"download"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"launchpad.net/gocheck"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+type WriterSuite struct {
+	ts  *httptest.Server
+	dir string
+}
+
+var _ = gocheck.Suite(new(WriterSuite))
+
+func Test(t *testing.T) { gocheck.TestingT(t) }
+
+func (s *WriterSuite) SetUpSuite(c *gocheck.C) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/old", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/new?b=2&a=1", http.StatusMovedPermanently)
+	})
+	mux.HandleFunc("/new", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, "<html><title>New</title></html>")
+	})
+	mux.HandleFunc("/big", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, strings.Repeat("x", 100))
+	})
+	s.ts = httptest.NewServer(mux)
+}
+
+func (s *WriterSuite) TearDownSuite(c *gocheck.C) {
+	s.ts.Close()
+}
+
+func (s *WriterSuite) SetUpTest(c *gocheck.C) {
+	s.dir = c.MkDir()
+}
+
+func (s *WriterSuite) TearDownTest(c *gocheck.C) {
+	download.SetRecorder(nil)
+}
+
+type testRecord struct {
+	header  textproto.MIMEHeader
+	content string
+}
+
+// readAll reads every record of a gzipped WARC file.
+func readAll(c *gocheck.C, name string) (records []testRecord) {
+	f, err := os.Open(name)
+	c.Assert(err, gocheck.IsNil)
+	defer f.Close()
+	br := bufio.NewReader(f)
+	gz, err := gzip.NewReader(br)
+	c.Assert(err, gocheck.IsNil)
+	for {
+		gz.Multistream(false)
+		r := textproto.NewReader(bufio.NewReader(gz))
+		version, err := r.ReadLine()
+		c.Assert(err, gocheck.IsNil)
+		c.Assert(version, gocheck.Equals, Version)
+		header, err := r.ReadMIMEHeader()
+		c.Assert(err, gocheck.IsNil)
+		n, err := strconv.Atoi(header.Get("Content-Length"))
+		c.Assert(err, gocheck.IsNil)
+		content := make([]byte, n)
+		_, err = io.ReadFull(r.R, content)
+		c.Assert(err, gocheck.IsNil)
+		rest, err := ioutil.ReadAll(r.R)
+		c.Assert(err, gocheck.IsNil)
+		c.Assert(string(rest), gocheck.Equals, "\r\n\r\n")
+		records = append(records, testRecord{header, string(content)})
+
+		if err = gz.Reset(br); err == io.EOF {
+			return
+		}
+		c.Assert(err, gocheck.IsNil)
+	}
+}
+
+func (s *WriterSuite) TestRecord(c *gocheck.C) {
+	w, err := NewWriter(s.dir, "test", 0, true)
+	c.Assert(err, gocheck.IsNil)
+	download.SetRecorder(w)
+	f, err := download.New("http", download.Options{})
+	c.Assert(err, gocheck.IsNil)
+	resp, err := f.Fetch(download.NewRequest(s.ts.URL + "/old"))
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(resp.StatusCode, gocheck.Equals, http.StatusOK)
+	c.Assert(w.Close(), gocheck.IsNil)
+
+	files, err := filepath.Glob(filepath.Join(s.dir, "test-*.warc.gz"))
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(files, gocheck.HasLen, 1)
+	records := readAll(c, files[0])
+	types := make([]string, len(records))
+	for i, r := range records {
+		types[i] = r.header.Get("WARC-Type")
+	}
+	c.Assert(types, gocheck.DeepEquals, []string{"warcinfo", "request", "response", "request", "response", "metadata"})
+
+	info := records[0].header.Get("WARC-Record-ID")
+	for _, r := range records[1:] {
+		c.Check(r.header.Get("WARC-Warcinfo-ID"), gocheck.Equals, info)
+	}
+	c.Check(records[1].header.Get("WARC-Target-URI"), gocheck.Equals, s.ts.URL+"/old")
+	c.Check(records[1].header.Get("WARC-Concurrent-To"), gocheck.Equals, records[2].header.Get("WARC-Record-ID"))
+	c.Check(records[1].content, gocheck.Matches, "(?s)GET /old HTTP/1.1\r\n.*User-Agent: .*")
+	c.Check(records[2].content, gocheck.Matches, "(?s)HTTP/1.1 301 Moved Permanently\r\n.*Location: /new\\?b=2&a=1\r\n.*")
+	c.Check(records[3].content, gocheck.Matches, "GET /new\\?b=2&a=1 HTTP/1.1\r\n(?s).*")
+	c.Check(records[4].header.Get("WARC-Target-URI"), gocheck.Equals, s.ts.URL+"/new?b=2&a=1")
+	c.Check(records[4].header.Get("WARC-IP-Address"), gocheck.Equals, "127.0.0.1")
+	c.Check(records[4].header.Get("WARC-Payload-Digest"), gocheck.Equals, digest([]byte("<html><title>New</title></html>")))
+	c.Check(strings.HasSuffix(records[4].content, "\r\n\r\n<html><title>New</title></html>"), gocheck.Equals, true)
+	c.Check(records[5].content, gocheck.Matches, "(?s).*via: "+s.ts.URL+"/old\r\n")
+
+	cdx, err := ioutil.ReadFile(files[0] + ".cdx")
+	c.Assert(err, gocheck.IsNil)
+	lines := strings.Split(strings.TrimRight(string(cdx), "\n"), "\n")
+	c.Assert(lines, gocheck.HasLen, 3)
+	c.Check(lines[0], gocheck.Equals, CDXHeader)
+	old := strings.Fields(lines[1])
+	c.Check(old[0], gocheck.Equals, SURT(s.ts.URL+"/old"))
+	c.Check(old[3:5], gocheck.DeepEquals, []string{"text/html", "301"})
+	c.Check(old[6], gocheck.Equals, "/new?b=2&a=1")
+	c.Check(old[10], gocheck.Equals, filepath.Base(files[0]))
+	new := strings.Fields(lines[2])
+	c.Check(new[3:5], gocheck.DeepEquals, []string{"text/html", "200"})
+
+	// The offsets point at gzip members that hold the response on their own
+	offset, _ := strconv.ParseInt(new[9], 10, 64)
+	length, _ := strconv.ParseInt(new[8], 10, 64)
+	fh, err := os.Open(files[0])
+	c.Assert(err, gocheck.IsNil)
+	defer fh.Close()
+	gz, err := gzip.NewReader(io.NewSectionReader(fh, offset, length))
+	c.Assert(err, gocheck.IsNil)
+	member, err := ioutil.ReadAll(gz)
+	c.Assert(err, gocheck.IsNil)
+	c.Check(string(member), gocheck.Matches, "(?s)WARC/1.1\r\nWARC-Type: response\r\n.*New</title></html>\r\n\r\n")
+}
+
+func (s *WriterSuite) TestTruncated(c *gocheck.C) {
+	for opts, exp := range map[*download.Options]string{
+		{}:                                  "",
+		{MaxBodySize: 50}:                   "length",
+		{ContentTypes: []string{"image/*"}}: "unspecified",
+	} {
+		s.dir = c.MkDir()
+		w, err := NewWriter(s.dir, "test", 0, true)
+		c.Assert(err, gocheck.IsNil)
+		download.SetRecorder(w)
+		f, err := download.New("http", *opts)
+		c.Assert(err, gocheck.IsNil)
+		f.Fetch(download.NewRequest(s.ts.URL + "/big"))
+		c.Assert(w.Close(), gocheck.IsNil)
+
+		files, err := Files(s.dir)
+		c.Assert(err, gocheck.IsNil)
+		c.Assert(files, gocheck.HasLen, 1)
+		records := readAll(c, files[0])
+		c.Assert(records[2].header.Get("WARC-Type"), gocheck.Equals, "response")
+		c.Check(records[2].header.Get("WARC-Truncated"), gocheck.Equals, exp, gocheck.Commentf("%+v", *opts))
+	}
+}
+
+func (s *WriterSuite) TestSecrets(c *gocheck.C) {
+	w, err := NewWriter(s.dir, "test", 0, false)
+	c.Assert(err, gocheck.IsNil)
+	download.SetRecorder(w)
+	f, err := download.New("http", download.Options{})
+	c.Assert(err, gocheck.IsNil)
+
+	login := download.NewFormRequest(s.ts.URL+"/new", url.Values{"user": {"moko"}, "password": {"hunter2"}})
+	login.Secret = true
+	_, err = f.Fetch(login)
+	c.Assert(err, gocheck.IsNil)
+	req := download.NewRequest(s.ts.URL + "/new")
+	req.Header.Set("Cookie", "session=s3cret")
+	req.Header.Set("Authorization", "Basic bW9rbzpodW50ZXIy")
+	_, err = f.Fetch(req)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(w.Close(), gocheck.IsNil)
+
+	files, err := Files(s.dir)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(files, gocheck.HasLen, 1)
+	data, err := ioutil.ReadFile(files[0])
+	c.Assert(err, gocheck.IsNil)
+	for _, secret := range []string{"hunter2", "s3cret", "bW9rbzpodW50ZXIy"} {
+		c.Check(strings.Contains(string(data), secret), gocheck.Equals, false, gocheck.Commentf(secret))
+	}
+	// Only the other request is there, without its credentials
+	c.Check(strings.Count(string(data), "WARC-Type: request\r\n"), gocheck.Equals, 1)
+	c.Check(strings.Contains(string(data), "\r\nCookie: redacted\r\n"), gocheck.Equals, true)
+}
+
+func (s *WriterSuite) TestRotate(c *gocheck.C) {
+	w, err := NewWriter(s.dir, "small", 1, false)
+	c.Assert(err, gocheck.IsNil)
+	for i := 0; i < 3; i++ {
+		c.Assert(w.Write(&Record{Type: "resource", Content: []byte("data")}), gocheck.IsNil)
+	}
+	c.Assert(w.Close(), gocheck.IsNil)
+	files, err := filepath.Glob(filepath.Join(s.dir, "small-*.warc"))
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(files, gocheck.HasLen, 3)
+	for _, name := range files {
+		data, err := ioutil.ReadFile(name)
+		c.Assert(err, gocheck.IsNil)
+		c.Check(strings.Count(string(data), Version+"\r\n"), gocheck.Equals, 2)
+		c.Check(string(data), gocheck.Matches, "WARC/1.1\r\nWARC-Type: warcinfo\r\n(?s).*WARC-Filename: "+filepath.Base(name)+"\r\n.*")
+	}
+}
+
+func (s *WriterSuite) TestSURT(c *gocheck.C) {
+	for url, key := range map[string]string{
+		"http://www.Moko.cc/a?b=1&a=2":  "cc,moko)/a?a=2&b=1",
+		"https://moko.cc":               "cc,moko)/",
+		"http://img.moko.cc:8080/x.jpg": "cc,moko,img:8080)/x.jpg",
+		"https://moko.cc:443/":          "cc,moko)/",
+	} {
+		c.Check(SURT(url), gocheck.Equals, key, gocheck.Commentf(url))
+	}
+}